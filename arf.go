@@ -0,0 +1,152 @@
+package smtp
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// A FeedbackReport is a parsed ARF abuse report (RFC 5965), as sent by
+// mailbox providers' feedback loops.
+type FeedbackReport struct {
+	// Description is the human-readable first part of the report.
+	Description string
+
+	// Fields holds all fields of the machine-readable part. The most
+	// common ones are parsed below.
+	Fields textproto.MIMEHeader
+
+	FeedbackType     string // such as "abuse"
+	UserAgent        string
+	OriginalMailFrom string
+	OriginalRcptTo   []string
+	SourceIP         net.IP
+	ArrivalDate      time.Time // zero if missing or malformed
+	ReportedDomain   string
+
+	// Original holds the headers of the reported message, if included.
+	Original mail.Header
+
+	// OriginalMessageID is the Message-ID of the reported message,
+	// including angle brackets, if known.
+	OriginalMessageID string
+
+	// Complainant is the address of the user who complained, taken from
+	// the Removal-Recipient or Original-Rcpt-To fields or the reported
+	// message's To header. Providers often redact it.
+	Complainant string
+}
+
+// ParseFeedbackReport parses an e-mail holding an ARF report.
+func ParseFeedbackReport(r io.Reader) (*FeedbackReport, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	if mediaType != "multipart/report" || !strings.EqualFold(params["report-type"], "feedback-report") {
+		return nil, errors.New("not a feedback report")
+	}
+
+	report := &FeedbackReport{}
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var body io.Reader = part
+		if strings.EqualFold(part.Header.Get("Content-Transfer-Encoding"), "base64") {
+			body = base64.NewDecoder(base64.StdEncoding, part)
+		}
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+
+		switch partType {
+		case "text/plain":
+			if report.Description == "" {
+				description, err := io.ReadAll(body)
+				if err != nil {
+					return nil, err
+				}
+				report.Description = string(description)
+			}
+		case "message/feedback-report":
+			fields, err := textproto.NewReader(bufio.NewReader(body)).ReadMIMEHeader()
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			report.Fields = fields
+		case "message/rfc822", "text/rfc822-headers":
+			original, err := textproto.NewReader(bufio.NewReader(body)).ReadMIMEHeader()
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			report.Original = mail.Header(original)
+		}
+	}
+	if report.Fields == nil {
+		return nil, errors.New("missing feedback-report part")
+	}
+
+	report.FeedbackType = report.Fields.Get("Feedback-Type")
+	report.UserAgent = report.Fields.Get("User-Agent")
+	report.OriginalMailFrom = strings.Trim(report.Fields.Get("Original-Mail-From"), "<>")
+	for _, to := range report.Fields.Values("Original-Rcpt-To") {
+		report.OriginalRcptTo = append(report.OriginalRcptTo, strings.Trim(to, "<>"))
+	}
+	report.SourceIP = net.ParseIP(report.Fields.Get("Source-Ip"))
+	if date, err := mail.ParseDate(report.Fields.Get("Arrival-Date")); err == nil {
+		report.ArrivalDate = date
+	}
+	report.ReportedDomain = report.Fields.Get("Reported-Domain")
+
+	if report.Original != nil {
+		report.OriginalMessageID = report.Original.Get("Message-Id")
+	}
+
+	report.Complainant = strings.Trim(report.Fields.Get("Removal-Recipient"), "<>")
+	if report.Complainant == "" && len(report.OriginalRcptTo) > 0 {
+		report.Complainant = report.OriginalRcptTo[0]
+	}
+	if report.Complainant == "" && report.Original != nil {
+		if to, err := report.Original.AddressList("To"); err == nil && len(to) > 0 {
+			report.Complainant = to[0].Address
+		}
+	}
+
+	if report.FeedbackType == "" {
+		return nil, errors.New("missing feedback-type")
+	}
+	return report, nil
+}
+
+var errNotFeedbackReport = &SMTPError{Code: 550, Enhanced: "5.6.0", Message: "only feedback reports accepted here"}
+
+// FeedbackHandler returns a Handler for a feedback loop address. It parses
+// each e-mail as an ARF report and passes it to handle, rejecting e-mails
+// that are not reports.
+func FeedbackHandler(handle func(ctx context.Context, m *Mail, report *FeedbackReport) error) Handler {
+	return func(ctx context.Context, m *Mail) error {
+		report, err := ParseFeedbackReport(strings.NewReader(m.Mail))
+		if err != nil {
+			return errNotFeedbackReport
+		}
+		return handle(ctx, m, report)
+	}
+}
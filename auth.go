@@ -0,0 +1,336 @@
+package smtp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An Authenticator checks a username and password for the AUTH extension.
+// It returns nil if they are valid. Returning an *SMTPError controls the
+// reply sent to the client, for example to signal a temporary failure.
+type Authenticator func(username, password string) error
+
+var errAuthFailed = &SMTPError{Code: 535, Enhanced: "5.7.8", Message: "authentication credentials invalid"}
+
+// A Mechanism is the server side of a SASL authentication mechanism, such
+// as PLAIN. Register mechanisms with WithMechanism.
+type Mechanism interface {
+	// Name returns the mechanism name advertised in EHLO.
+	Name() string
+
+	// Start begins an exchange with a client. state is the connection's
+	// TLS state, or nil if it is not encrypted.
+	Start(state *tls.ConnectionState) SASLServer
+}
+
+// A SASLServer runs the server side of one SASL exchange. Next is called
+// with each client response, starting with the initial response, which is
+// nil if the client sent none. It returns either a challenge to send to the
+// client, or done and the authenticated username. An *SMTPError controls the
+// reply sent on failure.
+type SASLServer interface {
+	Next(response []byte) (challenge []byte, done bool, username string, err error)
+}
+
+type mechanism struct {
+	name  string
+	start func(state *tls.ConnectionState) SASLServer
+}
+
+func (m *mechanism) Name() string {
+	return m.name
+}
+
+func (m *mechanism) Start(state *tls.ConnectionState) SASLServer {
+	return m.start(state)
+}
+
+type saslFunc func(response []byte) ([]byte, bool, string, error)
+
+func (f saslFunc) Next(response []byte) ([]byte, bool, string, error) {
+	return f(response)
+}
+
+// Plain returns the PLAIN mechanism (RFC 4616), checking credentials with
+// authenticate. Authorization identities other than the username itself are
+// refused.
+func Plain(authenticate Authenticator) Mechanism {
+	return &mechanism{name: "PLAIN", start: func(*tls.ConnectionState) SASLServer {
+		return saslFunc(func(response []byte) ([]byte, bool, string, error) {
+			if response == nil {
+				return []byte{}, false, "", nil
+			}
+			parts := bytes.Split(response, []byte{0})
+			if len(parts) != 3 {
+				return nil, false, "", errors.New("malformed plain response")
+			}
+			identity, username, password := string(parts[0]), string(parts[1]), string(parts[2])
+			if identity != "" && identity != username {
+				return nil, false, "", errAuthFailed
+			}
+			if err := authenticate(username, password); err != nil {
+				return nil, false, "", err
+			}
+			return nil, true, username, nil
+		})
+	}}
+}
+
+// Login returns the non-standard but widely used LOGIN mechanism, checking
+// credentials with authenticate.
+func Login(authenticate Authenticator) Mechanism {
+	return &mechanism{name: "LOGIN", start: func(*tls.ConnectionState) SASLServer {
+		var username *string
+		return saslFunc(func(response []byte) ([]byte, bool, string, error) {
+			if username == nil {
+				if response == nil {
+					return []byte("Username:"), false, "", nil
+				}
+				name := string(response)
+				username = &name
+				return []byte("Password:"), false, "", nil
+			}
+			if err := authenticate(*username, string(response)); err != nil {
+				return nil, false, "", err
+			}
+			return nil, true, *username, nil
+		})
+	}}
+}
+
+// CRAMMD5 returns the CRAM-MD5 mechanism (RFC 2195). secret looks up the
+// shared secret of a user.
+func CRAMMD5(secret func(username string) (string, error)) Mechanism {
+	return &mechanism{name: "CRAM-MD5", start: func(*tls.ConnectionState) SASLServer {
+		var challenge []byte
+		return saslFunc(func(response []byte) ([]byte, bool, string, error) {
+			if challenge == nil {
+				if response != nil {
+					return nil, false, "", errors.New("unexpected initial response")
+				}
+				challenge = cramChallenge()
+				return challenge, false, "", nil
+			}
+
+			idx := bytes.LastIndexByte(response, ' ')
+			if idx == -1 {
+				return nil, false, "", errors.New("malformed cram-md5 response")
+			}
+			username, digest := string(response[:idx]), response[idx+1:]
+			key, err := secret(username)
+			if err != nil {
+				return nil, false, "", err
+			}
+			mac := hmac.New(md5.New, []byte(key))
+			mac.Write(challenge)
+			expected := []byte(hex.EncodeToString(mac.Sum(nil)))
+			if !hmac.Equal(expected, bytes.ToLower(digest)) {
+				return nil, false, "", errAuthFailed
+			}
+			return nil, true, username, nil
+		})
+	}}
+}
+
+func cramChallenge() []byte {
+	var random [8]byte
+	rand.Read(random[:])
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	return []byte("<" + strconv.FormatUint(binary.BigEndian.Uint64(random[:]), 10) + "." +
+		strconv.FormatInt(time.Now().Unix(), 10) + "@" + hostname + ">")
+}
+
+// XOAuth2 returns Google's XOAUTH2 mechanism, checking bearer tokens with
+// verify.
+func XOAuth2(verify func(username, token string) error) Mechanism {
+	return oauthMechanism("XOAUTH2", verify, func(response []byte) (string, map[string]string) {
+		fields := oauthFields(string(response))
+		return fields["user"], fields
+	})
+}
+
+// OAuthBearer returns the OAUTHBEARER mechanism (RFC 7628), checking bearer
+// tokens with verify.
+func OAuthBearer(verify func(username, token string) error) Mechanism {
+	return oauthMechanism("OAUTHBEARER", verify, func(response []byte) (string, map[string]string) {
+		// The response starts with a GS2 header, such as "n,a=user,".
+		header, rest, _ := strings.Cut(string(response), "\x01")
+		var username string
+		for _, part := range strings.Split(header, ",") {
+			if strings.HasPrefix(part, "a=") {
+				username = part[2:]
+			}
+		}
+		return username, oauthFields(rest)
+	})
+}
+
+// oauthFields parses the \x01-separated key=value pairs of an OAuth
+// response.
+func oauthFields(s string) map[string]string {
+	fields := make(map[string]string)
+	for _, pair := range strings.Split(s, "\x01") {
+		if key, value, ok := strings.Cut(pair, "="); ok {
+			fields[key] = value
+		}
+	}
+	return fields
+}
+
+func oauthMechanism(name string, verify func(username, token string) error, parse func([]byte) (string, map[string]string)) Mechanism {
+	return &mechanism{name: name, start: func(*tls.ConnectionState) SASLServer {
+		var failure error
+		return saslFunc(func(response []byte) ([]byte, bool, string, error) {
+			if failure != nil {
+				// The client acknowledged the error challenge.
+				return nil, false, "", failure
+			}
+			if response == nil {
+				return []byte{}, false, "", nil
+			}
+
+			username, fields := parse(response)
+			token, ok := strings.CutPrefix(fields["auth"], "Bearer ")
+			if !ok || username == "" {
+				return nil, false, "", errors.New("malformed oauth response")
+			}
+			if err := verify(username, token); err != nil {
+				// Report the failure in a challenge, as the mechanisms
+				// require, and fail once the client responds.
+				failure = err
+				return []byte(`{"status":"invalid_token"}`), false, "", nil
+			}
+			return nil, true, username, nil
+		})
+	}}
+}
+
+// External returns the EXTERNAL mechanism (RFC 4422), which authenticates
+// clients by their TLS client certificate. identify maps the verified
+// connection state and the requested authorization identity, which may be
+// empty, to a username. Only certificates that crypto/tls verified are
+// accepted, so the tls.Config must set ClientAuth to VerifyClientCertIfGiven
+// or RequireAndVerifyClientCert, and ClientCAs to the trusted issuers.
+func External(identify func(state *tls.ConnectionState, identity string) (string, error)) Mechanism {
+	return &mechanism{name: "EXTERNAL", start: func(state *tls.ConnectionState) SASLServer {
+		return saslFunc(func(response []byte) ([]byte, bool, string, error) {
+			if state == nil || len(state.VerifiedChains) == 0 {
+				return nil, false, "", errAuthFailed
+			}
+			if response == nil {
+				return []byte{}, false, "", nil
+			}
+			username, err := identify(state, string(response))
+			if err != nil {
+				return nil, false, "", err
+			}
+			return nil, true, username, nil
+		})
+	}}
+}
+
+func (c *conn) authAllowed() bool {
+	return len(c.server.mechanisms) > 0 && (c.tls || c.server.insecureAuth)
+}
+
+func (c *conn) mechanismNames() string {
+	names := make([]string, len(c.server.mechanisms))
+	for i, m := range c.server.mechanisms {
+		names[i] = m.Name()
+	}
+	return strings.Join(names, " ")
+}
+
+func (c *conn) findMechanism(name string) Mechanism {
+	for _, m := range c.server.mechanisms {
+		if strings.EqualFold(m.Name(), name) {
+			return m
+		}
+	}
+	return nil
+}
+
+func (c *conn) tlsState() *tls.ConnectionState {
+	if tlsConn, ok := c.conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		return &state
+	}
+	return nil
+}
+
+// auth runs an AUTH exchange, reading client responses directly from the
+// connection. It returns false if the session should end.
+func (c *conn) auth(cmd *authCmd) bool {
+	if !c.esmtp || c.session.User != "" || c.state != initial || len(c.server.mechanisms) == 0 {
+		c.unexpectedCommand()
+		return true
+	}
+	if !c.authAllowed() {
+		c.encryptionRequired()
+		return true
+	}
+	mechanism := c.findMechanism(cmd.mechanism)
+	if mechanism == nil {
+		c.unsupportedMechanism()
+		return true
+	}
+	server := mechanism.Start(c.tlsState())
+
+	response := cmd.initialResponse
+	for {
+		challenge, done, username, err := server.Next(response)
+		if err != nil {
+			c.emit(EventAuthFailed, nil, err)
+		}
+		var smtpErr *SMTPError
+		if errors.As(err, &smtpErr) {
+			c.reply(smtpErr)
+			return true
+		} else if err != nil {
+			c.reply(errAuthFailed)
+			return true
+		}
+		if done {
+			c.session.User = username
+			c.emit(EventAuthSucceeded, nil, nil)
+			c.authSucceeded()
+			return true
+		}
+
+		c.write("334 " + base64.StdEncoding.EncodeToString(challenge) + "\r\n")
+		line, err := c.reader.ReadLine()
+		if err == errLineTooLong {
+			c.lineTooLong()
+			return true
+		}
+		if isTimeout(err) {
+			c.timedOut()
+			return false
+		}
+		if err != nil {
+			return false
+		}
+		if line == "*" {
+			c.authCancelled()
+			return true
+		}
+		if response, err = base64.StdEncoding.DecodeString(line); err != nil {
+			c.badBase64()
+			return true
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package smtp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func checkPassword(username, password string) error {
+	if username != "alice" || password != "secret" {
+		return errAuthFailed
+	}
+	return nil
+}
+
+func b64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func TestAuthMechanisms(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{"plain", "AUTH PLAIN " + b64("\x00alice\x00secret") + "\r\n",
+			[]string{"235 2.7.0 authentication successful"}},
+		{"plain without initial response", "AUTH PLAIN\r\n" + b64("\x00alice\x00secret") + "\r\n",
+			[]string{"334 ", "235 2.7.0 authentication successful"}},
+		{"plain bad password", "AUTH PLAIN " + b64("\x00alice\x00guess") + "\r\n",
+			[]string{"535 5.7.8 authentication credentials invalid"}},
+		{"plain other identity", "AUTH PLAIN " + b64("bob\x00alice\x00secret") + "\r\n",
+			[]string{"535 5.7.8 authentication credentials invalid"}},
+		{"plain malformed", "AUTH PLAIN " + b64("alice secret") + "\r\n",
+			[]string{"535 5.7.8 authentication credentials invalid"}},
+		{"login", "AUTH LOGIN\r\n" + b64("alice") + "\r\n" + b64("secret") + "\r\n",
+			[]string{"334 VXNlcm5hbWU6", "334 UGFzc3dvcmQ6", "235 2.7.0 authentication successful"}},
+		{"login bad password", "AUTH LOGIN\r\n" + b64("alice") + "\r\n" + b64("guess") + "\r\n",
+			[]string{"334 VXNlcm5hbWU6", "334 UGFzc3dvcmQ6", "535 5.7.8 authentication credentials invalid"}},
+		{"login cancelled", "AUTH LOGIN\r\n*\r\n",
+			[]string{"334 VXNlcm5hbWU6", "501 5.0.0 authentication cancelled"}},
+		{"unknown mechanism", "AUTH CRAM-MD5\r\n",
+			[]string{"504 5.5.4 unrecognized authentication type"}},
+	} {
+		s := NewServer("test", func(ctx context.Context, m *Mail) error {
+			return nil
+		}, WithAuthenticator(checkPassword), WithInsecureAuth())
+
+		replies := converse(t, s, "EHLO client\r\n"+tc.input+"QUIT\r\n")
+		if got := replies[len(replies)-len(tc.want)-1 : len(replies)-1]; !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got replies %q, want them to end in %q", tc.name, replies, tc.want)
+		}
+	}
+}
+
+func TestExternal(t *testing.T) {
+	cert := &x509.Certificate{}
+	for _, tc := range []struct {
+		name    string
+		state   *tls.ConnectionState
+		wantErr error
+	}{
+		{"verified", &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}, nil},
+		{"unverified", &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}, errAuthFailed},
+		{"no certificate", &tls.ConnectionState{}, errAuthFailed},
+		{"plaintext", nil, errAuthFailed},
+	} {
+		mechanism := External(func(state *tls.ConnectionState, identity string) (string, error) {
+			return "alice", nil
+		})
+
+		_, done, username, err := mechanism.Start(tc.state).Next([]byte{})
+		if err != tc.wantErr {
+			t.Errorf("%s: got error %v, want %v", tc.name, err, tc.wantErr)
+		}
+		if tc.wantErr == nil && (!done || username != "alice") {
+			t.Errorf("%s: got done %v, username %q, want alice", tc.name, done, username)
+		}
+	}
+}
+
+func TestAuthRequiresTLS(t *testing.T) {
+	s := NewServer("test", func(ctx context.Context, m *Mail) error {
+		return nil
+	}, WithTLSConfig(testTLSConfig(t)), WithAuthenticator(checkPassword))
+	c := dial(t, s)
+	login := "AUTH PLAIN " + b64("\x00alice\x00secret")
+
+	io.WriteString(c.conn, "EHLO client\r\n")
+	if ehlo := strings.Join(c.reply(), "\n"); strings.Contains(ehlo, "AUTH") {
+		t.Errorf("AUTH offered without TLS: %q", ehlo)
+	}
+	if got, want := c.cmd(login), "538 5.7.11 encryption required for authentication"; got != want {
+		t.Errorf("AUTH without TLS: got %q, want %q", got, want)
+	}
+
+	if got, want := c.cmd("STARTTLS"), "220 ready to start TLS"; got != want {
+		t.Fatalf("STARTTLS: got %q, want %q", got, want)
+	}
+	c.startTLS()
+	io.WriteString(c.conn, "EHLO client\r\n")
+	if ehlo := strings.Join(c.reply(), "\n"); !strings.Contains(ehlo, "250-AUTH PLAIN LOGIN") {
+		t.Errorf("AUTH not offered over TLS: %q", ehlo)
+	}
+	for _, step := range []struct {
+		command, want string
+	}{
+		{"MAIL FROM:<a@example.com>", "250 ok"},
+		{login, "503 did not expect that command"}, // in a transaction
+		{"RSET", "250 ok"},
+		{login, "235 2.7.0 authentication successful"},
+		{login, "503 did not expect that command"}, // once per session
+	} {
+		if got := c.cmd(step.command); got != step.want {
+			t.Errorf("%s: got %q, want %q", step.command, got, step.want)
+		}
+	}
+}
+
+func TestAuthResetByStartTLS(t *testing.T) {
+	var users []string
+	s := NewServer("test", func(ctx context.Context, m *Mail) error {
+		return nil
+	}, WithTLSConfig(testTLSConfig(t)), WithAuthenticator(checkPassword), WithInsecureAuth(),
+		WithSenderValidator(func(ctx context.Context, from string) error {
+			users = append(users, SessionFromContext(ctx).User)
+			return nil
+		}))
+	c := dial(t, s)
+	login := "AUTH PLAIN " + b64("\x00alice\x00secret")
+
+	for _, step := range []struct {
+		command, want string
+	}{
+		{login, "503 did not expect that command"}, // before EHLO
+		{"EHLO client", "250 SIZE 32768"},
+		{login, "235 2.7.0 authentication successful"},
+		{"MAIL FROM:<a@example.com>", "250 ok"},
+		{"RSET", "250 ok"},
+		{"STARTTLS", "220 ready to start TLS"},
+	} {
+		if got := c.cmd(step.command); got != step.want {
+			t.Fatalf("%s: got %q, want %q", step.command, got, step.want)
+		}
+	}
+	c.startTLS()
+	for _, step := range []struct {
+		command, want string
+	}{
+		{login, "503 did not expect that command"}, // the EHLO was forgotten
+		{"EHLO client", "250 SIZE 32768"},
+		{"MAIL FROM:<a@example.com>", "250 ok"},
+		{"RSET", "250 ok"},
+		{login, "235 2.7.0 authentication successful"},
+	} {
+		if got := c.cmd(step.command); got != step.want {
+			t.Fatalf("after STARTTLS, %s: got %q, want %q", step.command, got, step.want)
+		}
+	}
+
+	if want := []string{"alice", ""}; !reflect.DeepEqual(users, want) {
+		t.Errorf("sender validator saw users %q, want %q", users, want)
+	}
+}
@@ -11,6 +11,10 @@ type bufferedReader struct {
 	reader io.Reader
 	buffer []byte
 	r, w   int
+
+	// scan is the number of buffered bytes that ReadLine has already
+	// searched for a line ending.
+	scan int
 }
 
 func (b *bufferedReader) Fill() error {
@@ -40,6 +44,9 @@ func (b *bufferedReader) Read(data []byte) (n int, err error) {
 	}
 	copy(data, b.buffer[b.r:b.r+n])
 	b.r += n
+	if b.scan -= n; b.scan < 0 {
+		b.scan = 0
+	}
 	return n, nil
 }
 
@@ -47,24 +54,50 @@ func (b *bufferedReader) Buffered() []byte {
 	return b.buffer[b.r:b.w]
 }
 
+// errLineTooLong is returned by ReadLine for lines that do not fit in the
+// buffer. The whole line has been consumed when it is returned.
+var errLineTooLong = errors.New("line too long")
+
+// ReadLine returns the next CRLF-terminated line, without the CRLF. Bare CRs
+// and LFs are returned as part of the line.
 func (b *bufferedReader) ReadLine() (string, error) {
-	idx := 0
+	tooLong := false
 
 	for {
-		line := b.Buffered()
+		buffered := b.Buffered()
 
-		foundAt := bytes.Index(line[idx:], []byte("\r\n"))
-		if foundAt != -1 {
-			foundAt += idx
-			buf := make([]byte, foundAt+2)
-			b.Read(buf)
-			return string(buf[:foundAt]), nil
-		} else if len(line) >= 2 {
-			idx = len(line) - 2
+		// Bytes before b.scan hold no line ending, except possibly a CR
+		// at b.scan-1 that is completed by a LF at b.scan.
+		if idx := bytes.IndexByte(buffered[b.scan:], '\n'); idx != -1 {
+			end := b.scan + idx
+			if end > 0 && buffered[end-1] == '\r' {
+				line := string(buffered[:end-1])
+				b.r += end + 1
+				b.scan = 0
+				if tooLong {
+					return "", errLineTooLong
+				}
+				return line, nil
+			}
+			b.scan = end + 1
+			continue
 		}
+		b.scan = len(buffered)
 
-		if err := b.Fill(); err == io.EOF || err == bufio.ErrBufferFull {
-			return "", errors.New("line too long")
+		err := b.Fill()
+		if err == bufio.ErrBufferFull {
+			// Drop what we have, except for a CR that might start the
+			// line ending, and keep reading until the end of the line.
+			keep := 0
+			if buffered[len(buffered)-1] == '\r' {
+				keep = 1
+			}
+			b.r, b.scan = b.w-keep, 0
+			tooLong = true
+			continue
+		}
+		if err != nil && len(b.Buffered()) == len(buffered) {
+			return "", err
 		}
 	}
 }
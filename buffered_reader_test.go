@@ -0,0 +1,74 @@
+package smtp
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// readLines reads lines from b until an error other than errLineTooLong,
+// marking overlong lines and the final error in the result.
+func readLines(b *bufferedReader) []string {
+	var lines []string
+	for {
+		line, err := b.ReadLine()
+		switch err {
+		case nil:
+			lines = append(lines, line)
+		case errLineTooLong:
+			lines = append(lines, "<too long>")
+		default:
+			return append(lines, "<"+err.Error()+">")
+		}
+	}
+}
+
+func TestReadLine(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		size  int
+		input string
+		want  []string
+	}{
+		{"split line ending", 8, "abc\r\ndef\r\n", []string{"abc", "def", "<EOF>"}},
+		{"bare line endings", 16, "a\rb\nc\r\n\n\r\r\n", []string{"a\rb\nc", "\n\r", "<EOF>"}},
+		{"exactly full", 8, "123456\r\nok\r\n", []string{"123456", "ok", "<EOF>"}},
+		{"full buffer ending in CR", 8, "1234567\r\nok\r\n", []string{"<too long>", "ok", "<EOF>"}},
+		{"full buffer ending in bare CR", 8, "1234567\rx\r\nok\r\n", []string{"<too long>", "ok", "<EOF>"}},
+		{"overlong line", 8, strings.Repeat("x", 30) + "\r\nok\r\n", []string{"<too long>", "ok", "<EOF>"}},
+		{"overlong lines", 8, strings.Repeat("x", 30) + "\r\n" + strings.Repeat("y", 9) + "\r\nok\r\n", []string{"<too long>", "<too long>", "ok", "<EOF>"}},
+		{"unterminated", 8, "ok\r\npartial", []string{"ok", "<EOF>"}},
+	} {
+		for _, reader := range []struct {
+			name string
+			wrap func(io.Reader) io.Reader
+		}{
+			{"one byte", iotest.OneByteReader},
+			{"data with EOF", iotest.DataErrReader},
+			{"half", iotest.HalfReader},
+		} {
+			b := newBufferedReader(reader.wrap(strings.NewReader(tc.input)), tc.size)
+			if got := readLines(b); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("%s, %s reader: got %q, want %q", tc.name, reader.name, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestReadLineAfterRead(t *testing.T) {
+	// A BDAT chunk is read with Read between command lines.
+	b := newBufferedReader(iotest.DataErrReader(strings.NewReader("BDAT 7\r\nab\r\ncd\nQUIT\r\n")), 16)
+
+	if line, err := b.ReadLine(); line != "BDAT 7" || err != nil {
+		t.Fatalf("got %q, %v, want BDAT 7", line, err)
+	}
+	chunk := make([]byte, 7)
+	if _, err := io.ReadFull(b, chunk); err != nil || string(chunk) != "ab\r\ncd\n" {
+		t.Fatalf("got chunk %q, %v", chunk, err)
+	}
+	if got, want := readLines(b), []string{"QUIT", "<EOF>"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -6,11 +6,13 @@ type heloCmd struct {
 }
 
 type mailFromCmd struct {
-	from string
+	from   string
+	params map[string]string
 }
 
 type rcptToCmd struct {
-	to string
+	to     string
+	params map[string]string
 }
 
 type dataCmd struct {
@@ -28,6 +30,14 @@ type quitCmd struct {
 type vrfyCmd struct {
 }
 
+type authCmd struct {
+	mechanism       string
+	initialResponse []byte // nil if absent
+}
+
+type starttlsCmd struct {
+}
+
 type bdatCmd struct {
 	length int
 	last   bool
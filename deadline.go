@@ -0,0 +1,85 @@
+package smtp
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+type deadliner interface {
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// deadlineConn arms a fresh deadline before every read and write, so that
+// each protocol exchange gets its own timeout, capped by an overall
+// deadline. Zero timeouts and a zero deadline mean no limit. Connections
+// that do not support deadlines are used as is.
+//
+// While budgeted is set, reads are also limited to a budget of time, which
+// shrinks by the time spent waiting in each read, so that time between
+// reads does not count.
+type deadlineConn struct {
+	conn io.ReadWriteCloser
+
+	readTimeout, writeTimeout time.Duration
+	deadline                  time.Time
+
+	budgeted bool
+	budget   time.Duration
+
+	// paused leaves the read deadline alone, for a read that another
+	// goroutine interrupts by setting it.
+	paused bool
+
+	// read and written count the bytes transferred.
+	read, written *atomic.Int64
+}
+
+func (c *deadlineConn) deadlineFor(timeout time.Duration) time.Time {
+	var t time.Time
+	if timeout > 0 {
+		t = time.Now().Add(timeout)
+	}
+	if !c.deadline.IsZero() && (t.IsZero() || c.deadline.Before(t)) {
+		t = c.deadline
+	}
+	return t
+}
+
+func (c *deadlineConn) Read(p []byte) (n int, err error) {
+	defer func() { c.read.Add(int64(n)) }()
+	d, ok := c.conn.(deadliner)
+	if !ok || c.paused {
+		return c.conn.Read(p)
+	}
+	deadline := c.deadlineFor(c.readTimeout)
+	if c.budgeted {
+		start := time.Now()
+		if end := start.Add(c.budget); deadline.IsZero() || end.Before(deadline) {
+			deadline = end
+		}
+		defer func() { c.budget -= time.Since(start) }()
+	}
+	d.SetReadDeadline(deadline)
+	return c.conn.Read(p)
+}
+
+func (c *deadlineConn) Write(p []byte) (int, error) {
+	if d, ok := c.conn.(deadliner); ok {
+		d.SetWriteDeadline(c.deadlineFor(c.writeTimeout))
+	}
+	n, err := c.conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+func (c *deadlineConn) Close() error {
+	return c.conn.Close()
+}
+
+func isTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
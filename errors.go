@@ -0,0 +1,34 @@
+package smtp
+
+import (
+	"strconv"
+)
+
+// An SMTPError is an error that controls the reply sent to the client. Code
+// is the three-digit reply code and Enhanced the optional RFC 3463 enhanced
+// status code, such as "5.1.1".
+type SMTPError struct {
+	Code     int
+	Enhanced string
+	Message  string
+}
+
+func (e *SMTPError) Error() string {
+	if e.Enhanced == "" {
+		return strconv.Itoa(e.Code) + " " + e.Message
+	}
+	return strconv.Itoa(e.Code) + " " + e.Enhanced + " " + e.Message
+}
+
+// Temporary reports whether the client should retry later.
+func (e *SMTPError) Temporary() bool {
+	return e.Code >= 400 && e.Code < 500
+}
+
+var (
+	// ErrTempFail asks the client to retry later.
+	ErrTempFail = &SMTPError{Code: 451, Enhanced: "4.3.0", Message: "temporary failure, try again later"}
+
+	// ErrMailboxUnavailable permanently rejects a recipient.
+	ErrMailboxUnavailable = &SMTPError{Code: 550, Enhanced: "5.1.1", Message: "mailbox unavailable"}
+)
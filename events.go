@@ -0,0 +1,77 @@
+package smtp
+
+import (
+	"time"
+)
+
+// An EventType identifies what an Event records.
+type EventType string
+
+const (
+	EventConnect       EventType = "connect"        // a client connected
+	EventDisconnect    EventType = "disconnect"     // the session ended
+	EventAuthSucceeded EventType = "auth-succeeded" // Session.User is set
+	EventAuthFailed    EventType = "auth-failed"    // Err says why
+	EventRejected      EventType = "rejected"       // a recipient or e-mail was refused; Err says why
+	EventAccepted      EventType = "accepted"       // the handler accepted an e-mail
+)
+
+// An Event is a structured record of a security-relevant step of a session,
+// meant for audit trails rather than debugging. See WithEventSink.
+type Event struct {
+	Type    EventType
+	Time    time.Time
+	Session Session
+
+	// Envelope is the transaction the event is about, or nil.
+	Envelope *Envelope
+
+	// Err is the reason for a failure or rejection. It is usually an
+	// *SMTPError holding the reply sent to the client.
+	Err error
+}
+
+// emit passes an event to the server's event sink, if any.
+func (c *conn) emit(typ EventType, envelope *Envelope, err error) {
+	if c.server.eventSink == nil {
+		return
+	}
+	if envelope != nil {
+		copy := *envelope
+		copy.To = append([]string(nil), envelope.To...)
+		copy.RcptParams = append([]map[string]string(nil), envelope.RcptParams...)
+		envelope = &copy
+	}
+	c.server.eventSink(Event{
+		Type:     typ,
+		Time:     c.server.now(),
+		Session:  c.sessionInfo(),
+		Envelope: envelope,
+		Err:      err,
+	})
+}
+
+// A DeliveryResult tells how the handler fared with an e-mail. See
+// WithOnDelivered.
+type DeliveryResult struct {
+	// Err is nil if the e-mail was accepted. Otherwise it is the error the
+	// handler returned, or the error that broke off the transfer, in which
+	// case the handler's result was ignored.
+	Err error
+
+	// Duration is the time from Envelope.Received until the handler
+	// returned.
+	Duration time.Duration
+}
+
+// delivered passes the outcome of handling envelope's e-mail to the
+// server's delivery callback, if any.
+func (s *Server) delivered(envelope *Envelope, err error) {
+	if s.onDelivered == nil {
+		return
+	}
+	s.onDelivered(envelope, DeliveryResult{
+		Err:      err,
+		Duration: s.now().Sub(envelope.Received),
+	})
+}
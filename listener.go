@@ -0,0 +1,241 @@
+package smtp
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// A bucket is a token bucket that holds up to burst tokens and gains one
+// every interval.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens gained since the last refill.
+func (b *bucket) refill(now time.Time, interval time.Duration, burst int) {
+	b.tokens += float64(now.Sub(b.last)) / float64(interval)
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+}
+
+// rateInterval checks the arguments of the rate limiting listeners and
+// returns the interval between tokens and the burst to use.
+func rateInterval(name string, rate float64, burst int) (time.Duration, int) {
+	if !(rate > 0) {
+		panic("smtp: " + name + " with non-positive rate")
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return time.Duration(float64(time.Second) / rate), burst
+}
+
+type rateLimitListener struct {
+	net.Listener
+
+	mu       sync.Mutex
+	interval time.Duration
+	burst    int
+	bucket   bucket
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// LimitAcceptRate returns a listener that accepts at most rate connections
+// per second from l, allowing bursts of up to burst connections. Excess
+// connections wait in the kernel's accept queue. rate must be positive;
+// a burst below 1 is taken as 1.
+func LimitAcceptRate(l net.Listener, rate float64, burst int) net.Listener {
+	interval, burst := rateInterval("LimitAcceptRate", rate, burst)
+	return &rateLimitListener{
+		Listener: l,
+		interval: interval,
+		burst:    burst,
+		bucket:   bucket{tokens: float64(burst), last: time.Now()},
+		closed:   make(chan struct{}),
+	}
+}
+
+// reserve takes a token and returns how long to wait until it is valid.
+// Tokens taken ahead of time leave the bucket negative, so concurrent
+// callers line up behind each other.
+func (l *rateLimitListener) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.bucket.refill(time.Now(), l.interval, l.burst)
+	l.bucket.tokens--
+	if l.bucket.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.bucket.tokens * float64(l.interval))
+}
+
+func (l *rateLimitListener) Accept() (net.Conn, error) {
+	if wait := l.reserve(); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-l.closed:
+			return nil, net.ErrClosed
+		}
+	}
+	return l.Listener.Accept()
+}
+
+func (l *rateLimitListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+type ipRateLimitListener struct {
+	net.Listener
+
+	mu       sync.Mutex
+	interval time.Duration
+	burst    int
+	buckets  map[string]*bucket
+	swept    time.Time
+}
+
+// LimitAcceptRatePerIP returns a listener that immediately closes
+// connections from remote IPs that connect more than rate times per second,
+// allowing bursts of up to burst connections. rate must be positive; a
+// burst below 1 is taken as 1.
+func LimitAcceptRatePerIP(l net.Listener, rate float64, burst int) net.Listener {
+	interval, burst := rateInterval("LimitAcceptRatePerIP", rate, burst)
+	return &ipRateLimitListener{
+		Listener: l,
+		interval: interval,
+		burst:    burst,
+		buckets:  make(map[string]*bucket),
+		swept:    time.Now(),
+	}
+}
+
+// allow takes a token from ip's bucket, if it has one.
+func (l *ipRateLimitListener) allow(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &bucket{tokens: float64(l.burst), last: now}
+		l.buckets[ip] = b
+	}
+	b.refill(now, l.interval, l.burst)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep forgets the buckets that have filled up again, which are no
+// different from new ones, so that the map only holds recent clients.
+func (l *ipRateLimitListener) sweep(now time.Time) {
+	full := time.Duration(l.burst) * l.interval
+	if now.Sub(l.swept) < full {
+		return
+	}
+	for ip, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, ip)
+		}
+	}
+	l.swept = now
+}
+
+func (l *ipRateLimitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.allow(remoteIP(c)) {
+			return c, nil
+		}
+		c.Close()
+	}
+}
+
+type perIPListener struct {
+	net.Listener
+
+	mu    sync.Mutex
+	max   int
+	count map[string]int
+}
+
+// LimitConnectionsPerIP returns a listener that immediately closes
+// connections from remote IPs that already have max connections open.
+// max must be positive.
+func LimitConnectionsPerIP(l net.Listener, max int) net.Listener {
+	if max < 1 {
+		panic("smtp: LimitConnectionsPerIP with non-positive max")
+	}
+	return &perIPListener{
+		Listener: l,
+		max:      max,
+		count:    make(map[string]int),
+	}
+}
+
+func remoteIP(c net.Conn) string {
+	host, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		return c.RemoteAddr().String()
+	}
+	return host
+}
+
+func (l *perIPListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ip := remoteIP(c)
+		l.mu.Lock()
+		if l.count[ip] >= l.max {
+			l.mu.Unlock()
+			c.Close()
+			continue
+		}
+		l.count[ip]++
+		l.mu.Unlock()
+
+		return &perIPConn{Conn: c, listener: l, ip: ip}, nil
+	}
+}
+
+func (l *perIPListener) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.count[ip]--
+	if l.count[ip] == 0 {
+		delete(l.count, ip)
+	}
+}
+
+type perIPConn struct {
+	net.Conn
+	listener *perIPListener
+	ip       string
+	once     sync.Once
+}
+
+func (c *perIPConn) Close() error {
+	c.once.Do(func() { c.listener.release(c.ip) })
+	return c.Conn.Close()
+}
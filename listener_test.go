@@ -0,0 +1,172 @@
+package smtp
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pipeListener accepts an endless stream of pipe connections.
+type pipeListener struct {
+	net.Listener
+}
+
+func (pipeListener) Accept() (net.Conn, error) {
+	client, server := net.Pipe()
+	client.Close()
+	return server, nil
+}
+
+func (pipeListener) Close() error {
+	return nil
+}
+
+// addrConn is a connection from a given remote address.
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// connsFrom returns a listener that accepts connections from the given IPs,
+// and then fails. It also returns the client ends of the connections.
+func connsFrom(ips ...string) (net.Listener, []net.Conn) {
+	conns := make(chan net.Conn, len(ips))
+	var clients []net.Conn
+	for _, ip := range ips {
+		client, server := net.Pipe()
+		conns <- addrConn{Conn: server, remote: &net.TCPAddr{IP: net.ParseIP(ip), Port: 1000}}
+		clients = append(clients, client)
+	}
+	close(conns)
+	return &chanListener{conns: conns}, clients
+}
+
+type chanListener struct {
+	net.Listener
+	conns chan net.Conn
+}
+
+func (l *chanListener) Accept() (net.Conn, error) {
+	c, ok := <-l.conns
+	if !ok {
+		return nil, net.ErrClosed
+	}
+	return c, nil
+}
+
+// closed reports whether the server end of a pipe was closed.
+func closed(client net.Conn) bool {
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := client.Read(make([]byte, 1))
+	return err == io.EOF
+}
+
+func TestLimitAcceptRate(t *testing.T) {
+	l := LimitAcceptRate(pipeListener{}, 50, 2)
+
+	// The burst is accepted at once; the remaining connections come 20ms
+	// apart, even when accepted concurrently.
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := l.Accept(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 70*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Errorf("accepting 6 connections took %v, want about 80ms", elapsed)
+	}
+}
+
+func TestLimitAcceptRateArguments(t *testing.T) {
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("zero rate did not panic")
+			}
+		}()
+		LimitAcceptRate(pipeListener{}, 0, 1)
+	}()
+
+	l := LimitAcceptRate(pipeListener{}, 1000, 0)
+	if _, err := l.Accept(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLimitAcceptRateClose(t *testing.T) {
+	l := LimitAcceptRate(pipeListener{}, 1, 1)
+	if _, err := l.Accept(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next connection is a second away, but Close cuts the wait short.
+	time.AfterFunc(50*time.Millisecond, func() { l.Close() })
+	start := time.Now()
+	if _, err := l.Accept(); err != net.ErrClosed {
+		t.Errorf("got error %v, want net.ErrClosed", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Accept returned after %v, want about 50ms", elapsed)
+	}
+}
+
+func TestLimitAcceptRatePerIP(t *testing.T) {
+	inner, clients := connsFrom("192.0.2.1", "192.0.2.1", "192.0.2.1", "192.0.2.2")
+	l := LimitAcceptRatePerIP(inner, 1, 2)
+
+	var accepted []string
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			break
+		}
+		accepted = append(accepted, remoteIP(c))
+	}
+	if want := []string{"192.0.2.1", "192.0.2.1", "192.0.2.2"}; !reflect.DeepEqual(accepted, want) {
+		t.Errorf("accepted %q, want %q", accepted, want)
+	}
+	if !closed(clients[2]) {
+		t.Error("third connection from 192.0.2.1 not closed")
+	}
+}
+
+func TestLimitConnectionsPerIP(t *testing.T) {
+	inner, clients := connsFrom("192.0.2.1", "192.0.2.1", "192.0.2.2")
+	l := LimitConnectionsPerIP(inner, 1)
+
+	first, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The second connection from 192.0.2.1 is refused while the first is
+	// open.
+	if c, err := l.Accept(); err != nil || remoteIP(c) != "192.0.2.2" {
+		t.Errorf("got %v, %v, want the connection from 192.0.2.2", c, err)
+	}
+	if !closed(clients[1]) {
+		t.Error("second connection from 192.0.2.1 not closed")
+	}
+	first.Close()
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("zero max did not panic")
+			}
+		}()
+		LimitConnectionsPerIP(inner, 0)
+	}()
+}
@@ -0,0 +1,29 @@
+package smtp
+
+import (
+	"io"
+	"log/slog"
+)
+
+// transcript logs all protocol traffic of a session at debug level. See
+// WithTranscript.
+type transcript struct {
+	rw  io.ReadWriter
+	log *slog.Logger
+}
+
+func (t *transcript) Read(p []byte) (int, error) {
+	n, err := t.rw.Read(p)
+	if n > 0 {
+		t.log.Debug("read", "data", string(p[:n]))
+	}
+	return n, err
+}
+
+func (t *transcript) Write(p []byte) (int, error) {
+	n, err := t.rw.Write(p)
+	if n > 0 {
+		t.log.Debug("write", "data", string(p[:n]))
+	}
+	return n, err
+}
@@ -1,15 +1,33 @@
 package smtp
 
 import (
+	"encoding/base64"
 	"errors"
+	"slices"
 	"strconv"
 	"strings"
 )
 
+var (
+	errBadDomain  = &SMTPError{Code: 501, Enhanced: "5.5.2", Message: "control character in domain"}
+	errBadAddress = &SMTPError{Code: 501, Enhanced: "5.1.3", Message: "control character in address"}
+)
+
+// hasControl reports whether s holds an ASCII control character, which
+// could break up the headers the domains and addresses end up in.
+func hasControl(s string) bool {
+	return strings.IndexFunc(s, func(r rune) bool {
+		return r < ' ' || r == 0x7f
+	}) != -1
+}
+
 func parseDomain(line string) (string, error) {
 	if len(line) < 1 {
 		return "", errors.New("missing domain")
 	}
+	if hasControl(line) {
+		return "", errBadDomain
+	}
 	return line, nil
 }
 
@@ -19,9 +37,45 @@ func parseEmail(line string) (string, error) {
 	}
 
 	line = line[1 : len(line)-1]
+	if hasControl(line) {
+		return "", errBadAddress
+	}
 	return line, nil
 }
 
+var (
+	errUnknownParam   = &SMTPError{Code: 555, Enhanced: "5.5.4", Message: "unrecognized parameter"}
+	errDuplicateParam = &SMTPError{Code: 555, Enhanced: "5.5.4", Message: "duplicate parameter"}
+)
+
+// knownMailParams and knownRcptParams are the ESMTP parameters accepted by
+// MAIL and RCPT: those of the extensions the server implements, and those
+// of DSN (RFC 3461), for handlers to honor.
+var (
+	knownMailParams = []string{"SIZE", "BODY", "SMTPUTF8", "AUTH", "RET", "ENVID"}
+	knownRcptParams = []string{"NOTIFY", "ORCPT"}
+)
+
+// parseParams parses the ESMTP parameters of a MAIL or RCPT command, such as
+// "SIZE=1000 SMTPUTF8", into a map from upper-cased keywords to values,
+// which are empty for parameters without one. Keywords missing from known
+// and repeated keywords are refused (RFC 5321, section 4.1.1.11).
+func parseParams(line string, known []string) (map[string]string, error) {
+	params := make(map[string]string)
+	for _, param := range strings.Fields(line) {
+		key, value, _ := strings.Cut(param, "=")
+		key = strings.ToUpper(key)
+		if !slices.Contains(known, key) {
+			return nil, errUnknownParam
+		}
+		if _, ok := params[key]; ok {
+			return nil, errDuplicateParam
+		}
+		params[key] = value
+	}
+	return params, nil
+}
+
 func extractWord(in string) (string, string) {
 	idx := strings.Index(in, " ")
 	if idx == -1 {
@@ -30,7 +84,15 @@ func extractWord(in string) (string, string) {
 	return in[:idx], in[idx+1:]
 }
 
+var errBareLineEndingCommand = &SMTPError{Code: 501, Enhanced: "5.5.2", Message: "bare CR or LF in command"}
+
 func parseCommand(line string) (interface{}, error) {
+	// ReadLine leaves bare CRs and LFs in the line; a command holding one
+	// is an attempt to smuggle in a line the server would read differently.
+	if strings.ContainsAny(line, "\r\n") {
+		return nil, errBareLineEndingCommand
+	}
+
 	command, args := extractWord(line)
 
 	switch strings.ToLower(command) {
@@ -53,8 +115,7 @@ func parseCommand(line string) (interface{}, error) {
 			isEhlo: true,
 		}, nil
 	case "mail":
-		// eat all args to handle extensions
-		from, _ := extractWord(args)
+		from, params := extractWord(args)
 
 		if !strings.HasPrefix(strings.ToLower(from), "from:") {
 			return nil, errors.New("expected from: after mail")
@@ -63,19 +124,34 @@ func parseCommand(line string) (interface{}, error) {
 		if err != nil {
 			return nil, err
 		}
+		mailParams, err := parseParams(params, knownMailParams)
+		if err != nil {
+			return nil, err
+		}
 		return &mailFromCmd{
-			from: from,
+			from:   from,
+			params: mailParams,
 		}, nil
 	case "rcpt":
 		if !strings.HasPrefix(strings.ToLower(args), "to:") {
 			return nil, errors.New("expected to: after rcpt")
 		}
-		to, err := parseEmail(args[3:])
+		to, params := extractWord(args[3:])
+		to, err := parseEmail(to)
+		if err != nil {
+			return nil, err
+		}
+		if to == "" {
+			// Only the reverse path may be null.
+			return nil, errors.New("missing recipient")
+		}
+		rcptParams, err := parseParams(params, knownRcptParams)
 		if err != nil {
 			return nil, err
 		}
 		return &rcptToCmd{
-			to: to,
+			to:     to,
+			params: rcptParams,
 		}, nil
 	case "bdat":
 		length, args := extractWord(args)
@@ -112,6 +188,29 @@ func parseCommand(line string) (interface{}, error) {
 			return nil, errors.New("unexpected quit args")
 		}
 		return &quitCmd{}, nil
+	case "auth":
+		mechanism, initial := extractWord(args)
+		if mechanism == "" {
+			return nil, errors.New("missing auth mechanism")
+		}
+		var response []byte
+		if initial == "=" {
+			response = []byte{}
+		} else if initial != "" {
+			var err error
+			if response, err = base64.StdEncoding.DecodeString(initial); err != nil {
+				return nil, errors.New("bad initial response")
+			}
+		}
+		return &authCmd{
+			mechanism:       mechanism,
+			initialResponse: response,
+		}, nil
+	case "starttls":
+		if args != "" {
+			return nil, errors.New("unexpected starttls args")
+		}
+		return &starttlsCmd{}, nil
 	case "vrfy":
 		return &vrfyCmd{}, nil
 	default:
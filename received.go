@@ -0,0 +1,219 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// A Hop is a single parsed Received header. Fields missing from the header
+// are left empty.
+type Hop struct {
+	From string // host name the sending client announced
+	IP   net.IP // address of the sending client, if recorded
+	By   string // host name of the receiving server
+	With string // protocol, such as ESMTP or ESMTPS
+	ID   string
+	For  string
+	Date time.Time
+}
+
+// ParseReceivedChain parses all Received headers of a message, most recent
+// hop first.
+func ParseReceivedChain(header mail.Header) ([]Hop, error) {
+	var hops []Hop
+	for _, value := range header["Received"] {
+		hop, err := ParseReceived(value)
+		if err != nil {
+			return nil, err
+		}
+		hops = append(hops, hop)
+	}
+	return hops, nil
+}
+
+// ParseReceived parses the value of a single Received header.
+func ParseReceived(value string) (Hop, error) {
+	var hop Hop
+
+	value = strings.Join(strings.Fields(value), " ") // unfold
+	idx := strings.LastIndex(value, ";")
+	if idx == -1 {
+		return hop, errors.New("missing date in received header")
+	}
+	date, err := mail.ParseDate(strings.TrimSpace(value[idx+1:]))
+	if err != nil {
+		return hop, err
+	}
+	hop.Date = date
+
+	var clause string
+	for _, token := range tokenizeReceived(value[:idx]) {
+		if strings.HasPrefix(token, "(") {
+			if clause == "from" && hop.IP == nil {
+				hop.IP = findAddressLiteral(token)
+			}
+			continue
+		}
+
+		switch keyword := strings.ToLower(token); keyword {
+		case "from", "by", "via", "with", "id", "for":
+			clause = keyword
+			continue
+		}
+
+		switch clause {
+		case "from":
+			if hop.From == "" {
+				hop.From = token
+				if ip := findAddressLiteral(token); ip != nil {
+					hop.IP = ip
+				}
+			}
+		case "by":
+			if hop.By == "" {
+				hop.By = token
+			}
+		case "with":
+			if hop.With == "" {
+				hop.With = token
+			}
+		case "id":
+			if hop.ID == "" {
+				hop.ID = token
+			}
+		case "for":
+			if hop.For == "" {
+				hop.For = strings.TrimSuffix(strings.TrimPrefix(token, "<"), ">")
+			}
+		}
+	}
+
+	return hop, nil
+}
+
+// tokenizeReceived splits a Received header into words, keeping
+// parenthesized comments (which may nest) as single tokens.
+func tokenizeReceived(in string) []string {
+	var tokens []string
+	depth, start := 0, -1
+
+	for i := 0; i < len(in); i++ {
+		switch c := in[i]; {
+		case c == '(':
+			if depth == 0 {
+				if start != -1 {
+					tokens = append(tokens, in[start:i])
+				}
+				start = i
+			}
+			depth++
+		case c == ')' && depth > 0:
+			depth--
+			if depth == 0 {
+				tokens = append(tokens, in[start:i+1])
+				start = -1
+			}
+		case c == ' ' && depth == 0:
+			if start != -1 {
+				tokens = append(tokens, in[start:i])
+				start = -1
+			}
+		default:
+			if start == -1 {
+				start = i
+			}
+		}
+	}
+	if start != -1 {
+		tokens = append(tokens, in[start:])
+	}
+	return tokens
+}
+
+// findAddressLiteral returns the first [address] literal in s, if any.
+func findAddressLiteral(s string) net.IP {
+	for {
+		open := strings.Index(s, "[")
+		if open == -1 {
+			return nil
+		}
+		end := strings.Index(s[open:], "]")
+		if end == -1 {
+			return nil
+		}
+		literal := s[open+1 : open+end]
+		if len(literal) > 5 && strings.EqualFold(literal[:5], "ipv6:") {
+			literal = literal[5:]
+		}
+		if ip := net.ParseIP(literal); ip != nil {
+			return ip
+		}
+		s = s[open+end+1:]
+	}
+}
+
+// heloName makes a client's HELO name safe to record in a Received header.
+// It should be a domain or address literal; other characters, which could
+// end the clause or start a comment, become question marks.
+func heloName(helo string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+			return r
+		case strings.ContainsRune(".-_:[]", r):
+			return r
+		}
+		return '?'
+	}, helo)
+}
+
+// receivedHeader formats the Received header the server adds to envelope's
+// e-mail (RFC 5321, section 4.4), with the protocol names of RFC 3848.
+func (c *conn) receivedHeader(envelope *Envelope) string {
+	var ip string
+	if addr, ok := envelope.RemoteAddr.(*net.TCPAddr); ok {
+		if addr.IP.To4() != nil {
+			ip = "[" + addr.IP.String() + "]"
+		} else {
+			ip = "[IPv6:" + addr.IP.String() + "]"
+		}
+	}
+	from := heloName(envelope.Helo)
+	if from == "" {
+		from = ip
+	}
+	if from == "" {
+		// The clause needs a name, even without HELO and TCP.
+		from = "unknown"
+	}
+
+	with := "SMTP"
+	if c.esmtp {
+		with = "ESMTP"
+		if envelope.TLS != nil {
+			with += "S"
+		}
+		if envelope.User != "" {
+			with += "A"
+		}
+	}
+
+	header := "Received: from " + from
+	if ip != "" {
+		header += " (" + ip + ")"
+	}
+	header += "\r\n\tby " + c.server.receivedHost + " (jellevandenhooff/smtp)\r\n\twith " + with
+	if envelope.TLS != nil {
+		header += " (" + tls.VersionName(envelope.TLS.Version) + " " + tls.CipherSuiteName(envelope.TLS.CipherSuite) + ")"
+	}
+	header += "\r\n\tid " + envelope.ID
+	if len(envelope.To) == 1 {
+		// Naming one of several recipients would leak it to the others.
+		header += "\r\n\tfor <" + envelope.To[0] + ">"
+	}
+	return header + ";\r\n\t" + envelope.Received.Format(time.RFC1123Z) + "\r\n"
+}
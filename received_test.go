@@ -0,0 +1,49 @@
+package smtp
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReceivedHeader(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		greeting string
+		from     string
+		with     string
+	}{
+		{"unsafe helo", "EHLO evil(x);y\r\n", "evil?x??y", "ESMTP"},
+		{"no helo", "", "unknown", "SMTP"},
+	} {
+		date := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+		var got string
+		s := NewServer("test", func(ctx context.Context, m *Mail) error {
+			got = m.Mail
+			return nil
+		}, WithReceivedHeader("mx.example.com"), WithClock(func() time.Time { return date }), WithIDGenerator(func() string { return "id1" }))
+
+		converse(t, s, tc.greeting+"MAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.com>\r\nDATA\r\nSubject: hi\r\n\r\nhello\r\n.\r\nQUIT\r\n")
+
+		want := "Received: from " + tc.from + "\r\n" +
+			"\tby mx.example.com (jellevandenhooff/smtp)\r\n" +
+			"\twith " + tc.with + "\r\n" +
+			"\tid id1\r\n" +
+			"\tfor <b@example.com>;\r\n" +
+			"\tThu, 02 Jan 2020 03:04:05 +0000\r\n" +
+			"Subject: hi\r\n"
+		if !strings.HasPrefix(got, want) {
+			t.Errorf("%s: got e-mail %q, want it to start with %q", tc.name, got, want)
+			continue
+		}
+
+		hop, err := ParseReceived(strings.TrimPrefix(strings.SplitN(got, "\r\nSubject", 2)[0], "Received: "))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hop.From != tc.from || hop.By != "mx.example.com" || hop.With != tc.with || hop.ID != "id1" || hop.For != "b@example.com" || !hop.Date.Equal(date) {
+			t.Errorf("%s: got hop %+v", tc.name, hop)
+		}
+	}
+}
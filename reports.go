@@ -0,0 +1,342 @@
+package smtp
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// A TLSReport is an SMTP TLS report (RFC 8460).
+type TLSReport struct {
+	OrganizationName string `json:"organization-name"`
+	DateRange        struct {
+		Start time.Time `json:"start-datetime"`
+		End   time.Time `json:"end-datetime"`
+	} `json:"date-range"`
+	ContactInfo string            `json:"contact-info"`
+	ReportID    string            `json:"report-id"`
+	Policies    []TLSPolicyResult `json:"policies"`
+}
+
+// A TLSPolicyResult holds a TLSReport's results for one policy.
+type TLSPolicyResult struct {
+	Policy struct {
+		Type   string   `json:"policy-type"` // "sts", "tlsa", or "no-policy-found"
+		String []string `json:"policy-string"`
+		Domain string   `json:"policy-domain"`
+		MXHost []string `json:"mx-host"`
+	} `json:"policy"`
+	Summary struct {
+		Successful int `json:"total-successful-session-count"`
+		Failed     int `json:"total-failure-session-count"`
+	} `json:"summary"`
+	FailureDetails []struct {
+		ResultType            string `json:"result-type"`
+		SendingMTAIP          string `json:"sending-mta-ip"`
+		ReceivingMXHostname   string `json:"receiving-mx-hostname"`
+		ReceivingMXHelo       string `json:"receiving-mx-helo"`
+		ReceivingIP           string `json:"receiving-ip"`
+		FailedSessionCount    int    `json:"failed-session-count"`
+		AdditionalInformation string `json:"additional-information"`
+		FailureReasonCode     string `json:"failure-reason-code"`
+	} `json:"failure-details"`
+}
+
+// A DMARCReport is a DMARC aggregate report (RFC 7489, appendix C).
+type DMARCReport struct {
+	Metadata struct {
+		OrgName   string `xml:"org_name"`
+		Email     string `xml:"email"`
+		ReportID  string `xml:"report_id"`
+		DateRange struct {
+			Begin int64 `xml:"begin"` // Unix time
+			End   int64 `xml:"end"`
+		} `xml:"date_range"`
+	} `xml:"report_metadata"`
+	PolicyPublished struct {
+		Domain string `xml:"domain"`
+		ADKIM  string `xml:"adkim"`
+		ASPF   string `xml:"aspf"`
+		P      string `xml:"p"`
+		SP     string `xml:"sp"`
+		Pct    int    `xml:"pct"`
+	} `xml:"policy_published"`
+	Records []DMARCRecord `xml:"record"`
+}
+
+// A DMARCRecord holds a DMARCReport's results for one source and set of
+// identifiers.
+type DMARCRecord struct {
+	Row struct {
+		SourceIP        string `xml:"source_ip"`
+		Count           int    `xml:"count"`
+		PolicyEvaluated struct {
+			Disposition string `xml:"disposition"`
+			DKIM        string `xml:"dkim"`
+			SPF         string `xml:"spf"`
+		} `xml:"policy_evaluated"`
+	} `xml:"row"`
+	Identifiers struct {
+		HeaderFrom   string `xml:"header_from"`
+		EnvelopeFrom string `xml:"envelope_from"`
+	} `xml:"identifiers"`
+	AuthResults struct {
+		DKIM []struct {
+			Domain   string `xml:"domain"`
+			Selector string `xml:"selector"`
+			Result   string `xml:"result"`
+		} `xml:"dkim"`
+		SPF []struct {
+			Domain string `xml:"domain"`
+			Scope  string `xml:"scope"`
+			Result string `xml:"result"`
+		} `xml:"spf"`
+	} `xml:"auth_results"`
+}
+
+// maxReportSize bounds decompressed reports, to defuse compression bombs.
+const maxReportSize = 32 * 1024 * 1024
+
+// decompress returns the content of a gzip file, the first file in a zip
+// archive, or data itself.
+func decompress(data []byte) ([]byte, error) {
+	var r io.Reader
+	switch {
+	case bytes.HasPrefix(data, []byte("\x1f\x8b")):
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		r = gz
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+		if len(archive.File) == 0 {
+			return nil, errors.New("empty zip archive")
+		}
+		f, err := archive.File[0].Open()
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	default:
+		return data, nil
+	}
+
+	out, err := io.ReadAll(io.LimitReader(r, maxReportSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxReportSize {
+		return nil, errors.New("report too large")
+	}
+	return out, nil
+}
+
+// ParseTLSReport parses a TLS report, which may be gzip-compressed.
+func ParseTLSReport(data []byte) (*TLSReport, error) {
+	data, err := decompress(data)
+	if err != nil {
+		return nil, err
+	}
+	var report TLSReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// ParseDMARCReport parses a DMARC aggregate report, which may be gzip- or
+// zip-compressed.
+func ParseDMARCReport(data []byte) (*DMARCReport, error) {
+	data, err := decompress(data)
+	if err != nil {
+		return nil, err
+	}
+	var report DMARCReport
+	if err := xml.Unmarshal(data, &report); err != nil {
+		return nil, err
+	}
+	if report.Metadata.ReportID == "" {
+		return nil, errors.New("missing report id")
+	}
+	return &report, nil
+}
+
+type attachment struct {
+	mediaType string
+	data      []byte
+}
+
+// attachments returns the decoded leaf parts of an e-mail.
+func attachments(header mail.Header, body io.Reader) ([]attachment, error) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		var all []attachment
+		parts := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := parts.NextPart()
+			if err == io.EOF {
+				return all, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			found, err := attachments(mail.Header(part.Header), part)
+			if err != nil {
+				return nil, err
+			}
+			all = append(all, found...)
+		}
+	}
+
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return []attachment{{mediaType: mediaType, data: data}}, nil
+}
+
+func isMailbox(address string, mailboxes []string) bool {
+	for _, mailbox := range mailboxes {
+		if strings.EqualFold(address, mailbox) {
+			return true
+		}
+	}
+	return false
+}
+
+// withRecipients returns a copy of m addressed only to the recipients for
+// which keep returns want.
+func withRecipients(m *Mail, keep func(string) bool, want bool) *Mail {
+	copy := *m
+	copy.To, copy.RcptParams = nil, nil
+	for i, to := range m.To {
+		if keep(to) != want {
+			continue
+		}
+		copy.To = append(copy.To, to)
+		if i < len(m.RcptParams) {
+			copy.RcptParams = append(copy.RcptParams, m.RcptParams[i])
+		}
+	}
+	return &copy
+}
+
+var errNoReport = &SMTPError{Code: 550, Enhanced: "5.6.0", Message: "no report found"}
+
+// reportHandler passes e-mails to mailboxes to handle with each of their
+// attachments that parse, and e-mails to other recipients to next. An
+// e-mail to both is split between them.
+func reportHandler(mailboxes []string, handle func(ctx context.Context, m *Mail, a attachment) (bool, error), next Handler) Handler {
+	return func(ctx context.Context, m *Mail) error {
+		isReportMailbox := func(to string) bool { return isMailbox(to, mailboxes) }
+		reports := withRecipients(m, isReportMailbox, true)
+		others := withRecipients(m, isReportMailbox, false)
+
+		if len(others.To) > 0 {
+			if next == nil {
+				return ErrMailboxUnavailable
+			}
+			if err := next(ctx, others); err != nil {
+				return err
+			}
+		}
+		if len(reports.To) == 0 {
+			return nil
+		}
+
+		err := handleReport(ctx, reports, handle)
+		if err == errNoReport && len(others.To) > 0 {
+			// The e-mail was for the other recipients, with a report
+			// mailbox copied in; rejecting it now would bounce it for
+			// them too.
+			return nil
+		}
+		return err
+	}
+}
+
+func handleReport(ctx context.Context, m *Mail, handle func(ctx context.Context, m *Mail, a attachment) (bool, error)) error {
+	msg, err := mail.ReadMessage(strings.NewReader(m.Mail))
+	if err != nil {
+		return errNoReport
+	}
+	found, err := attachments(msg.Header, msg.Body)
+	if err != nil {
+		return errNoReport
+	}
+	for _, a := range found {
+		if ok, err := handle(ctx, m, a); ok {
+			return err
+		}
+	}
+	return errNoReport
+}
+
+// TLSReportHandler returns a Handler that parses TLS reports sent to any
+// of mailboxes, such as the address published in a domain's TLSRPT record,
+// and passes them to handle. E-mails to these mailboxes without a report are
+// rejected. Other e-mails are passed to next, or rejected if next is nil.
+//
+// An e-mail addressed both to report mailboxes and to other recipients is
+// passed to next addressed to the other recipients only, and then to handle
+// addressed to the report mailboxes. It is not rejected for lacking a
+// report. If either returns an error, the client is sent that error for all
+// recipients, so next may see the e-mail again when the client retries.
+func TLSReportHandler(mailboxes []string, handle func(ctx context.Context, m *Mail, report *TLSReport) error, next Handler) Handler {
+	return reportHandler(mailboxes, func(ctx context.Context, m *Mail, a attachment) (bool, error) {
+		if a.mediaType != "application/tlsrpt+gzip" && a.mediaType != "application/tlsrpt+json" {
+			return false, nil
+		}
+		report, err := ParseTLSReport(a.data)
+		if err != nil {
+			return false, nil
+		}
+		return true, handle(ctx, m, report)
+	}, next)
+}
+
+// DMARCReportHandler returns a Handler that parses DMARC aggregate reports
+// sent to any of mailboxes, such as the rua address published in a domain's
+// DMARC record, and passes them to handle. E-mails to these mailboxes
+// without a report are rejected. Other e-mails are passed to next, or
+// rejected if next is nil. E-mails to both are split as described for
+// TLSReportHandler.
+func DMARCReportHandler(mailboxes []string, handle func(ctx context.Context, m *Mail, report *DMARCReport) error, next Handler) Handler {
+	return reportHandler(mailboxes, func(ctx context.Context, m *Mail, a attachment) (bool, error) {
+		if strings.HasPrefix(a.mediaType, "text/plain") || strings.HasPrefix(a.mediaType, "text/html") {
+			return false, nil
+		}
+		report, err := ParseDMARCReport(a.data)
+		if err != nil {
+			return false, nil
+		}
+		return true, handle(ctx, m, report)
+	}, next)
+}
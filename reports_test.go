@@ -0,0 +1,53 @@
+package smtp
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+const dmarcReportMail = "Subject: Report Domain: example.com\r\n" +
+	"Content-Type: application/xml\r\n" +
+	"\r\n" +
+	"<feedback><report_metadata><org_name>example.net</org_name><report_id>r1</report_id></report_metadata>" +
+	"<policy_published><domain>example.com</domain></policy_published></feedback>\r\n"
+
+func TestDMARCReportHandlerRecipients(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		to         []string
+		mail       string
+		wantErr    error
+		wantNext   []string
+		wantReport []string
+	}{
+		{"report", []string{"rua@example.com"}, dmarcReportMail, nil, nil, []string{"rua@example.com"}},
+		{"no report", []string{"rua@example.com"}, "Subject: hi\r\n\r\nhello\r\n", errNoReport, nil, nil},
+		{"other", []string{"alice@example.com"}, "Subject: hi\r\n\r\nhello\r\n", nil, []string{"alice@example.com"}, nil},
+		{"report and other", []string{"alice@example.com", "RUA@example.com", "bob@example.com"}, dmarcReportMail, nil, []string{"alice@example.com", "bob@example.com"}, []string{"RUA@example.com"}},
+		{"copied in", []string{"alice@example.com", "rua@example.com"}, "Subject: hi\r\n\r\nhello\r\n", nil, []string{"alice@example.com"}, nil},
+	} {
+		var gotNext, gotReport []string
+		handler := DMARCReportHandler([]string{"rua@example.com"}, func(ctx context.Context, m *Mail, report *DMARCReport) error {
+			gotReport = m.To
+			if report.Metadata.ReportID != "r1" {
+				t.Errorf("%s: got report id %q", tc.name, report.Metadata.ReportID)
+			}
+			return nil
+		}, func(ctx context.Context, m *Mail) error {
+			gotNext = m.To
+			return nil
+		})
+
+		err := handler(context.Background(), &Mail{Envelope: Envelope{To: tc.to}, Mail: tc.mail})
+		if err != tc.wantErr {
+			t.Errorf("%s: got error %v, want %v", tc.name, err, tc.wantErr)
+		}
+		if !reflect.DeepEqual(gotNext, tc.wantNext) {
+			t.Errorf("%s: next got recipients %q, want %q", tc.name, gotNext, tc.wantNext)
+		}
+		if !reflect.DeepEqual(gotReport, tc.wantReport) {
+			t.Errorf("%s: handle got recipients %q, want %q", tc.name, gotReport, tc.wantReport)
+		}
+	}
+}
@@ -0,0 +1,630 @@
+package smtp
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// A Server is an SMTP server. Use NewServer to create one.
+type Server struct {
+	domain     string
+	handler    StreamHandler
+	middleware []Middleware
+
+	tlsConfig  *tls.Config
+	handshakes chan struct{} // slots for TLS handshakes, or nil
+
+	mechanisms   []Mechanism
+	insecureAuth bool
+
+	newID         func() string
+	now           func() time.Time
+	receivedHost  string
+	eventSink     func(Event)
+	onDelivered   func(*Envelope, DeliveryResult)
+	logger        *slog.Logger
+	transcript    bool
+	maxRecipients int
+	maxSize       int
+
+	readBufferSize int
+
+	onConnect         ConnectHook
+	validateSender    SenderValidator
+	validateRecipient RecipientValidator
+	ackFirst          bool
+
+	commandTimeout  time.Duration
+	dataTimeout     time.Duration
+	transferTimeout time.Duration
+	sessionTimeout  time.Duration
+
+	mu           sync.Mutex
+	shuttingDown bool
+	listeners    map[net.Listener]struct{}
+	conns        map[*conn]struct{}
+
+	pending sync.WaitGroup // handlers running after WithAckBeforeHandler
+}
+
+// ErrServerClosed is returned by Serve and ServeTLS after Shutdown or Close.
+var ErrServerClosed = errors.New("server closed")
+
+// An Option configures a Server.
+type Option func(*Server)
+
+// WithTLSConfig enables the STARTTLS extension using config, which must hold
+// at least one certificate.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(s *Server) {
+		s.tlsConfig = config
+	}
+}
+
+// WithMaxHandshakes limits the number of TLS handshakes in progress at
+// once, which are costly for the server but cheap for a client to start. A
+// connection made with ServeTLS while n handshakes run is closed right away,
+// and STARTTLS is answered with a temporary failure. n must not be
+// negative; zero means no limit, the default.
+func WithMaxHandshakes(n int) Option {
+	if n < 0 {
+		panic("smtp: WithMaxHandshakes with negative n")
+	}
+	return func(s *Server) {
+		s.handshakes = nil
+		if n > 0 {
+			s.handshakes = make(chan struct{}, n)
+		}
+	}
+}
+
+// WithAuthenticator enables the AUTH extension with the PLAIN and LOGIN
+// mechanisms, checking credentials with authenticate. AUTH is only offered
+// over TLS unless WithInsecureAuth is also given.
+func WithAuthenticator(authenticate Authenticator) Option {
+	return WithMechanism(Plain(authenticate), Login(authenticate))
+}
+
+// WithMechanism enables the AUTH extension with the given mechanisms, in
+// addition to any registered before. Mechanisms are advertised in the order
+// they are registered.
+func WithMechanism(mechanisms ...Mechanism) Option {
+	return func(s *Server) {
+		s.mechanisms = append(s.mechanisms, mechanisms...)
+	}
+}
+
+// WithInsecureAuth allows AUTH on connections without TLS, sending
+// passwords in the clear. Only use it on trusted networks.
+func WithInsecureAuth() Option {
+	return func(s *Server) {
+		s.insecureAuth = true
+	}
+}
+
+// WithIDGenerator sets the function that generates Envelope.ID for each
+// transaction. It must be safe for concurrent use and return unique IDs.
+// The default generates ULIDs.
+func WithIDGenerator(newID func() string) Option {
+	return func(s *Server) {
+		s.newID = newID
+	}
+}
+
+// WithClock sets the function that tells the server the time, for
+// Envelope.Received and Received headers. The default is time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(s *Server) {
+		s.now = now
+	}
+}
+
+// WithReceivedHeader makes the server prepend a Received header to every
+// e-mail, recording the client, the protocol and TLS details, and naming
+// the receiving server hostname, such as the server's domain.
+func WithReceivedHeader(hostname string) Option {
+	return func(s *Server) {
+		s.receivedHost = hostname
+	}
+}
+
+// WithEventSink passes an Event to sink for every connection, AUTH attempt,
+// rejection and accepted e-mail. sink is called synchronously by the
+// session, so it should be quick, and it must be safe for concurrent use.
+func WithEventSink(sink func(Event)) Option {
+	return func(s *Server) {
+		s.eventSink = sink
+	}
+}
+
+// WithOnDelivered calls onDelivered every time the handler finished with
+// an e-mail, with its envelope and the outcome, for audit logs and latency
+// tracking. It is called synchronously, before the client gets its reply,
+// so it should be quick, and it must be safe for concurrent use. With
+// WithAckBeforeHandler it is called from the background handler instead.
+func WithOnDelivered(onDelivered func(envelope *Envelope, result DeliveryResult)) Option {
+	return func(s *Server) {
+		s.onDelivered = onDelivered
+	}
+}
+
+// WithLogger makes the server log to logger. Every record carries the
+// session ID and the client's address. Temporary failures are logged at
+// error level, timeouts and failed TLS handshakes at info level, and the
+// start and end of sessions at debug level. By default nothing is logged.
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Server) {
+		s.logger = logger
+	}
+}
+
+// WithTranscript logs all protocol traffic, decrypted, at debug level, for
+// debugging. The transcript includes the e-mails and AUTH credentials.
+func WithTranscript() Option {
+	return func(s *Server) {
+		s.transcript = true
+	}
+}
+
+// MinReadBufferSize is the smallest read buffer WithReadBufferSize allows,
+// which holds the longest command line RFC 5321 requires servers to accept.
+const MinReadBufferSize = 1000
+
+// WithReadBufferSize sets the size in bytes of each connection's read
+// buffer, which bounds the length of protocol lines, including the lines of
+// e-mails sent with DATA. Longer lines are refused. The default is
+// MaxLineLength; sizes below MinReadBufferSize are raised to it.
+func WithReadBufferSize(size int) Option {
+	return func(s *Server) {
+		s.readBufferSize = max(size, MinReadBufferSize)
+	}
+}
+
+// WithMaxMessageSize sets the maximum e-mail size in bytes, advertised
+// with the SIZE extension. size must not be negative; zero means no limit.
+// The default is SizeLimit. A Handler holds each e-mail in memory; use a
+// StreamHandler to store large e-mails elsewhere as they arrive.
+func WithMaxMessageSize(size int) Option {
+	if size < 0 {
+		panic("smtp: WithMaxMessageSize with negative size")
+	}
+	return func(s *Server) {
+		s.maxSize = size
+	}
+}
+
+// WithCommandTimeout sets how long the server waits for each command and
+// for writes to complete. The default is 5 minutes, as RFC 5321 suggests.
+// Zero means no limit.
+func WithCommandTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.commandTimeout = timeout
+	}
+}
+
+// WithDataTimeout sets how long the server waits for each read of an e-mail
+// being transferred with DATA or BDAT. The default is 3 minutes, as RFC 5321
+// suggests. Zero means no limit. Only time spent waiting for the client
+// counts: the timeout restarts with every read, so a StreamHandler that is
+// slow to consume the e-mail does not make it expire.
+func WithDataTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.dataTimeout = timeout
+	}
+}
+
+// WithTransferTimeout limits the total time a client may take to transfer
+// an e-mail, from the start of DATA or the first BDAT until the end of its
+// content. Unlike WithDataTimeout it also reaps clients that keep trickling
+// in data. Only time spent waiting for the client counts, so a StreamHandler
+// that is slow to consume the e-mail does not make it expire. The default is
+// zero, meaning no limit; RFC 5321 suggests clients wait 10 minutes for the
+// final reply.
+func WithTransferTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.transferTimeout = timeout
+	}
+}
+
+// WithSessionTimeout limits the total duration of a connection. The default
+// is zero, meaning no limit.
+func WithSessionTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.sessionTimeout = timeout
+	}
+}
+
+// WithMaxRecipients sets the number of recipients accepted per message.
+// Further RCPT commands are answered with a temporary failure, so the
+// client sends the remaining recipients in another transaction. Zero means
+// no limit. The default is 100, the minimum RFC 5321 requires.
+func WithMaxRecipients(n int) Option {
+	return func(s *Server) {
+		s.maxRecipients = n
+	}
+}
+
+// WithConnectHook calls hook for every new connection before greeting the
+// client.
+func WithConnectHook(hook ConnectHook) Option {
+	return func(s *Server) {
+		s.onConnect = hook
+	}
+}
+
+// WithSenderValidator checks the sender of every transaction with validate
+// before accepting it.
+func WithSenderValidator(validate SenderValidator) Option {
+	return func(s *Server) {
+		s.validateSender = validate
+	}
+}
+
+// WithRecipientValidator checks every recipient with validate before
+// accepting it.
+func WithRecipientValidator(validate RecipientValidator) Option {
+	return func(s *Server) {
+		s.validateRecipient = validate
+	}
+}
+
+// WithAckBeforeHandler accepts each e-mail as soon as it has been received,
+// and only then passes it to the handler, in the background. This keeps
+// clients from waiting on slow handlers, but gives at-most-once delivery:
+// e-mails are lost if the handler fails or the process dies, and errors
+// returned by the handler are only logged. By default the server replies
+// once the handler returned, so e-mails are delivered at least once.
+//
+// The whole e-mail is held in memory, as with a Handler. The handler's ctx
+// is not canceled when the connection closes. Shutdown waits for running
+// handlers.
+func WithAckBeforeHandler() Option {
+	return func(s *Server) {
+		s.ackFirst = true
+	}
+}
+
+// WithStreamHandler passes received e-mails to handler as they arrive,
+// instead of to the Handler given to NewServer, which may then be nil.
+func WithStreamHandler(handler StreamHandler) Option {
+	return func(s *Server) {
+		s.handler = handler
+	}
+}
+
+// WithMiddleware wraps the server's handler in middleware, in addition to
+// any registered before. It covers message delivery only; see Middleware.
+// The first registered middleware is outermost: it sees each e-mail first
+// and the result last. Middleware is applied once all options are, so it
+// wraps the handler regardless of option order.
+func WithMiddleware(middleware ...Middleware) Option {
+	return func(s *Server) {
+		s.middleware = append(s.middleware, middleware...)
+	}
+}
+
+// NewServer returns a Server that announces itself as domain and passes
+// received e-mails to handler. domain should be ASCII, as it is sent before
+// clients can ask for SMTPUTF8; other characters are replaced. NewServer
+// panics if handler is nil and no WithStreamHandler option is given.
+func NewServer(domain string, handler Handler, opts ...Option) *Server {
+	s := &Server{
+		domain:        replyText(domain, false),
+		newID:         newULID,
+		now:           time.Now,
+		logger:        slog.New(slog.DiscardHandler),
+		maxRecipients: 100,
+		maxSize:       SizeLimit,
+
+		readBufferSize: MaxLineLength,
+
+		commandTimeout: 5 * time.Minute,
+		dataTimeout:    3 * time.Minute,
+	}
+	if handler != nil {
+		s.handler = handler.stream()
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.handler == nil {
+		panic("smtp: NewServer with nil handler")
+	}
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		s.handler = s.middleware[i](s.handler)
+	}
+	return s
+}
+
+// Serve accepts connections on listener and handles each in its own
+// goroutine. Returns an error if the listener fails.
+func (s *Server) Serve(listener net.Listener) error {
+	return s.serve(listener, false)
+}
+
+// ServeTLS is like Serve, but speaks TLS from the first byte on, as on
+// submission port 465 (RFC 8314). The server must have been configured
+// with WithTLSConfig. STARTTLS is not offered on these connections.
+func (s *Server) ServeTLS(listener net.Listener) error {
+	if s.tlsConfig == nil {
+		return errors.New("missing tls config")
+	}
+	return s.serve(listener, true)
+}
+
+// ListenAndServe listens on the TCP address addr and calls Serve. If addr
+// is empty, it listens on port 25.
+func (s *Server) ListenAndServe(addr string) error {
+	if addr == "" {
+		addr = ":25"
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// ListenAndServeTLS listens on the TCP address addr and calls ServeTLS. If
+// addr is empty, it listens on port 465.
+func (s *Server) ListenAndServeTLS(addr string) error {
+	if addr == "" {
+		addr = ":465"
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.ServeTLS(listener)
+}
+
+func (s *Server) serve(listener net.Listener, implicitTLS bool) error {
+	if !s.trackListener(listener, true) {
+		return ErrServerClosed
+	}
+	defer s.trackListener(listener, false)
+
+	for {
+		var c io.ReadWriteCloser
+		c, err := listener.Accept()
+		if err != nil {
+			if s.closed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		if implicitTLS {
+			c = tls.Server(c.(net.Conn), s.tlsConfig)
+		}
+
+		conn := s.newConn(c, implicitTLS)
+		if !s.trackConn(conn, true) {
+			c.Close()
+			continue
+		}
+		go conn.handle()
+	}
+}
+
+// newConn sets up a session on transport, ready to handle.
+func (s *Server) newConn(transport io.ReadWriteCloser, implicitTLS bool) *conn {
+	conn := &conn{
+		server: s,
+		tls:    implicitTLS,
+	}
+	conn.session.ID = s.newID()
+	conn.log = s.logger.With("session", conn.session.ID)
+	if nc, ok := transport.(net.Conn); ok {
+		conn.session.RemoteAddr = nc.RemoteAddr()
+		conn.log = conn.log.With("remote", conn.session.RemoteAddr.String())
+	}
+	conn.started = s.now()
+	conn.status, conn.statusSince = StateConnecting, conn.started
+	conn.published = conn.session
+	conn.ctx, conn.cancel = context.WithCancel(context.Background())
+	conn.setTransport(transport)
+	conn.rw.read, conn.rw.written = &conn.bytesRead, &conn.bytesWritten
+	conn.rw.readTimeout = s.commandTimeout
+	conn.rw.writeTimeout = s.commandTimeout
+	if s.sessionTimeout > 0 {
+		conn.rw.deadline = time.Now().Add(s.sessionTimeout)
+	}
+	return conn
+}
+
+// startHandshake takes a handshake slot, if one is free. See
+// WithMaxHandshakes.
+func (s *Server) startHandshake() bool {
+	if s.handshakes == nil {
+		return true
+	}
+	select {
+	case s.handshakes <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// endHandshake frees the slot taken by startHandshake.
+func (s *Server) endHandshake() {
+	if s.handshakes != nil {
+		<-s.handshakes
+	}
+}
+
+func (s *Server) closed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shuttingDown
+}
+
+func (s *Server) trackListener(listener net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !add {
+		delete(s.listeners, listener)
+		return true
+	}
+	if s.shuttingDown {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[listener] = struct{}{}
+	return true
+}
+
+func (s *Server) trackConn(c *conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !add {
+		delete(s.conns, c)
+		return true
+	}
+	if s.shuttingDown {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[*conn]struct{})
+	}
+	s.conns[c] = struct{}{}
+	return true
+}
+
+// Sessions returns a snapshot of the active sessions, oldest first.
+func (s *Server) Sessions() []SessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	sessions := make([]SessionInfo, 0, len(s.conns))
+	for c := range s.conns {
+		sessions = append(sessions, c.info(now))
+	}
+	slices.SortFunc(sessions, func(a, b SessionInfo) int {
+		return cmp.Compare(b.Duration, a.Duration)
+	})
+	return sessions
+}
+
+// CloseSession closes the active session with the given ID, and reports
+// whether there was one. A session waiting for a command is sent 421
+// first. A session in the middle of a command or an e-mail is closed
+// without a reply, as one could not be told apart from the reply it is
+// sending; the context of a running handler is canceled.
+func (s *Server) CloseSession(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.conns {
+		c.mu.Lock()
+		found := c.published.ID == id && !c.closed
+		if found {
+			var reply string
+			if c.idle {
+				reply = "421 4.7.0 " + s.domain + " closing connection\r\n"
+			}
+			c.goodbye(reply)
+		}
+		c.mu.Unlock()
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// closeListeners stops accepting new connections. s.mu must be held.
+func (s *Server) closeListeners() error {
+	var err error
+	for listener := range s.listeners {
+		if cerr := listener.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// shutdownPollInterval is how often Shutdown checks for sessions that
+// have become idle.
+const shutdownPollInterval = 100 * time.Millisecond
+
+// Shutdown gracefully stops the server. It stops accepting connections,
+// then sends 421 to every session that is waiting for a command and closes
+// it. Sessions in the middle of receiving a message are closed once they
+// finish it. Shutdown then waits for handlers still running in the
+// background (see WithAckBeforeHandler). If ctx expires first, Shutdown
+// closes all remaining connections and returns ctx.Err().
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.shuttingDown = true
+	err := s.closeListeners()
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConns() {
+			return s.waitPending(ctx, err)
+		}
+		select {
+		case <-ctx.Done():
+			s.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// waitPending waits for background handlers, after all connections closed.
+func (s *Server) waitPending(ctx context.Context, err error) error {
+	done := make(chan struct{})
+	go func() {
+		s.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// closeIdleConns closes all sessions waiting for a command, and reports
+// whether no sessions remain.
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.conns {
+		c.closeIfIdle()
+	}
+	return len(s.conns) == 0
+}
+
+// Close immediately closes all listeners and connections. Use Shutdown to
+// let sessions finish their current message.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.shuttingDown = true
+	err := s.closeListeners()
+	for c := range s.conns {
+		c.close()
+	}
+	return err
+}
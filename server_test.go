@@ -0,0 +1,366 @@
+package smtp
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serve runs s on a local listener, returning its address and the error
+// Serve returns.
+func serve(t *testing.T, s *Server) (string, <-chan error) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- s.Serve(listener) }()
+	t.Cleanup(func() { s.Close() })
+	return listener.Addr().String(), errc
+}
+
+// sendMail connects to addr and sends commands, returning a reader for the
+// replies, positioned after the greeting.
+func sendMail(t *testing.T, addr, commands string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	if _, err := r.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(conn, commands); err != nil {
+		t.Fatal(err)
+	}
+	return conn, r
+}
+
+// readUntil reads replies until one starting with prefix.
+func readUntil(t *testing.T, r *bufio.Reader, prefix string) {
+	t.Helper()
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("waiting for %q: %v", prefix, err)
+		}
+		if strings.HasPrefix(line, prefix) {
+			return
+		}
+	}
+}
+
+func TestShutdownIdle(t *testing.T) {
+	s := NewServer("test", func(ctx context.Context, m *Mail) error {
+		return nil
+	})
+	addr, errc := serve(t, s)
+
+	_, r := sendMail(t, addr, "EHLO client\r\n")
+	readUntil(t, r, "250 ")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	readUntil(t, r, "421 test shutting down")
+	if _, err := r.ReadString('\n'); err != io.EOF {
+		t.Errorf("got %v after 421, want EOF", err)
+	}
+	if err := <-errc; err != ErrServerClosed {
+		t.Errorf("Serve returned %v, want ErrServerClosed", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if err := s.Serve(listener); err != ErrServerClosed {
+		t.Errorf("Serve after Shutdown returned %v, want ErrServerClosed", err)
+	}
+}
+
+func TestShutdownWaitsForTransaction(t *testing.T) {
+	started, release := make(chan bool), make(chan bool)
+	s := NewServer("test", func(ctx context.Context, m *Mail) error {
+		started <- true
+		<-release
+		return nil
+	})
+	addr, _ := serve(t, s)
+
+	_, r := sendMail(t, addr, "EHLO client\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.com>\r\nDATA\r\nhello\r\n.\r\n")
+	<-started
+
+	done := make(chan error, 1)
+	go func() { done <- s.Shutdown(context.Background()) }()
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned %v while a transaction was in flight", err)
+	case <-time.After(3 * shutdownPollInterval):
+	}
+
+	close(release)
+	readUntil(t, r, "354 ")
+	for _, want := range []string{"250 ok\r\n", "421 test shutting down\r\n"} {
+		if got, err := r.ReadString('\n'); got != want {
+			t.Errorf("got reply %q, %v, want %q", got, err, want)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+}
+
+func TestShutdownContextExpires(t *testing.T) {
+	started, canceled := make(chan bool), make(chan bool, 1)
+	s := NewServer("test", func(ctx context.Context, m *Mail) error {
+		started <- true
+		<-ctx.Done()
+		canceled <- true
+		return ctx.Err()
+	})
+	addr, errc := serve(t, s)
+
+	_, r := sendMail(t, addr, "EHLO client\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.com>\r\nDATA\r\nhello\r\n.\r\n")
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*shutdownPollInterval)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown returned %v, want context.DeadlineExceeded", err)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler context not canceled")
+	}
+	readUntil(t, r, "354 ")
+	if line, err := r.ReadString('\n'); err == nil {
+		t.Errorf("got reply %q, want the connection closed", line)
+	}
+	if err := <-errc; err != ErrServerClosed {
+		t.Errorf("Serve returned %v, want ErrServerClosed", err)
+	}
+}
+
+func TestMaxHandshakes(t *testing.T) {
+	config := testTLSConfig(t)
+	s := NewServer("test", func(ctx context.Context, m *Mail) error {
+		return nil
+	}, WithTLSConfig(config), WithMaxHandshakes(1))
+
+	// A client that never starts its handshake takes the only slot.
+	stalled, server := net.Pipe()
+	go s.newConn(tls.Server(server, config), true).handle()
+	waitFor(t, func() bool { return len(s.handshakes) == 1 })
+
+	client, server := net.Pipe()
+	go s.newConn(tls.Server(server, config), true).handle()
+	if !closed(client) {
+		t.Error("implicit TLS connection not closed")
+	}
+
+	c := dial(t, s)
+	c.cmd("EHLO client")
+	if got, want := c.cmd("STARTTLS"), "454 4.7.0 TLS not available due to temporary reason"; got != want {
+		t.Errorf("STARTTLS: got %q, want %q", got, want)
+	}
+
+	stalled.Close()
+	waitFor(t, func() bool { return len(s.handshakes) == 0 })
+	if got, want := c.cmd("STARTTLS"), "220 ready to start TLS"; got != want {
+		t.Fatalf("STARTTLS: got %q, want %q", got, want)
+	}
+	c.startTLS()
+}
+
+// waitFor waits until cond holds.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	for start := time.Now(); !cond(); time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("timed out")
+		}
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	for _, tc := range []struct {
+		size int
+		want string
+	}{
+		{100, "250 SIZE 100"},
+		{0, "250 SIZE 0"},
+	} {
+		s := NewServer("test", func(ctx context.Context, m *Mail) error {
+			return nil
+		}, WithMaxMessageSize(tc.size))
+		if got := dial(t, s).cmd("EHLO client"); got != tc.want {
+			t.Errorf("size %d: got %q, want %q", tc.size, got, tc.want)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("negative size did not panic")
+		}
+	}()
+	WithMaxMessageSize(-1)
+}
+
+func TestNewServerNilHandler(t *testing.T) {
+	NewServer("test", nil, WithStreamHandler(func(ctx context.Context, envelope *Envelope, body io.Reader) error {
+		return nil
+	}))
+
+	defer func() {
+		if recover() == nil {
+			t.Error("nil handler did not panic")
+		}
+	}()
+	NewServer("test", nil)
+}
+
+func TestOnDelivered(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		ackFirst bool
+		mail     string
+		wantErr  error
+	}{
+		{"accepted", false, "hello", nil},
+		{"rejected", false, "reject", ErrMailboxUnavailable},
+		{"broken off", false, strings.Repeat("x", 2*MinReadBufferSize), errLineTooLong},
+		{"accepted first", true, "hello", nil},
+		{"failed after accepting", true, "reject", ErrMailboxUnavailable},
+	} {
+		start := time.Now()
+		results := make(chan DeliveryResult, 1)
+		opts := []Option{
+			WithReadBufferSize(MinReadBufferSize),
+			WithOnDelivered(func(envelope *Envelope, result DeliveryResult) {
+				if envelope.Received.Before(start) || envelope.To[0] != "b@example.com" {
+					t.Errorf("%s: got envelope %+v", tc.name, envelope)
+				}
+				results <- result
+			}),
+		}
+		if tc.ackFirst {
+			opts = append(opts, WithAckBeforeHandler())
+		}
+		s := NewServer("test", func(ctx context.Context, m *Mail) error {
+			if m.Mail == "reject\r\n" {
+				return ErrMailboxUnavailable
+			}
+			return nil
+		}, opts...)
+
+		converse(t, s, "EHLO client\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.com>\r\nDATA\r\n"+tc.mail+"\r\n.\r\nQUIT\r\n")
+		result := <-results
+		if result.Err != tc.wantErr || result.Duration <= 0 || result.Duration > time.Since(start) {
+			t.Errorf("%s: got result %+v, want error %v", tc.name, result, tc.wantErr)
+		}
+	}
+}
+
+func TestSessions(t *testing.T) {
+	started, release := make(chan bool), make(chan bool)
+	s := NewServer("test", func(ctx context.Context, m *Mail) error {
+		started <- true
+		<-release
+		return nil
+	})
+	addr, _ := serve(t, s)
+	defer close(release)
+
+	_, r := sendMail(t, addr, "EHLO idle\r\n")
+	readUntil(t, r, "250 ")
+	time.Sleep(10 * time.Millisecond)
+	sendMail(t, addr, "EHLO busy\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.com>\r\nDATA\r\nhello\r\n.\r\n")
+	<-started
+
+	var sessions []SessionInfo
+	waitFor(t, func() bool {
+		sessions = s.Sessions()
+		return len(sessions) == 2 && sessions[0].State == StateIdle
+	})
+	for i, want := range []struct {
+		helo  string
+		state SessionState
+	}{
+		{"idle", StateIdle},
+		{"busy", StateData},
+	} {
+		got := sessions[i]
+		if got.Helo != want.helo || got.State != want.state {
+			t.Errorf("session %d: got helo %q in state %q, want %q in %q", i, got.Helo, got.State, want.helo, want.state)
+		}
+		if got.ID == "" || got.RemoteAddr == nil || got.BytesRead == 0 || got.BytesWritten == 0 || got.StateDuration > got.Duration {
+			t.Errorf("session %d: got %+v", i, got)
+		}
+	}
+}
+
+func TestCloseSession(t *testing.T) {
+	started, canceled := make(chan bool), make(chan bool, 1)
+	s := NewServer("test", func(ctx context.Context, m *Mail) error {
+		started <- true
+		<-ctx.Done()
+		canceled <- true
+		return ctx.Err()
+	})
+	addr, _ := serve(t, s)
+
+	_, idle := sendMail(t, addr, "EHLO idle\r\n")
+	readUntil(t, idle, "250 ")
+	_, busy := sendMail(t, addr, "EHLO busy\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.com>\r\nDATA\r\nhello\r\n.\r\n")
+	<-started
+	readUntil(t, busy, "354 ")
+
+	ids := map[string]string{}
+	waitFor(t, func() bool {
+		for _, session := range s.Sessions() {
+			if session.State == StateIdle || session.State == StateData {
+				ids[session.Helo] = session.ID
+			}
+		}
+		return len(ids) == 2
+	})
+
+	if !s.CloseSession(ids["idle"]) {
+		t.Error("CloseSession(idle) reported no session")
+	}
+	readUntil(t, idle, "421 4.7.0 test closing connection")
+	if _, err := idle.ReadString('\n'); err != io.EOF {
+		t.Errorf("got %v after 421, want EOF", err)
+	}
+
+	if !s.CloseSession(ids["busy"]) {
+		t.Error("CloseSession(busy) reported no session")
+	}
+	<-canceled
+	if line, err := busy.ReadString('\n'); err == nil {
+		t.Errorf("got reply %q, want the connection closed", line)
+	}
+
+	waitFor(t, func() bool { return len(s.Sessions()) == 0 })
+	if s.CloseSession(ids["idle"]) {
+		t.Error("CloseSession of a closed session reported a session")
+	}
+}
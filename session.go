@@ -0,0 +1,101 @@
+package smtp
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// A Session describes the connection an e-mail is received on.
+type Session struct {
+	// ID uniquely identifies the connection. See WithIDGenerator.
+	ID string
+
+	// RemoteAddr is the client's address, or nil if the transport is not a
+	// net.Conn.
+	RemoteAddr net.Addr
+
+	// Helo is the name the client gave in its HELO or EHLO command, or
+	// empty if it has not sent one yet.
+	Helo string
+
+	// TLS holds the state of the connection, or nil if it is in plaintext.
+	TLS *tls.ConnectionState
+
+	// User is the name the client authenticated as, or empty.
+	User string
+}
+
+// A SessionState tells what an active session is doing. See
+// Server.Sessions.
+type SessionState string
+
+const (
+	StateConnecting SessionState = "connecting" // in the TLS handshake or connect hook
+	StateIdle       SessionState = "idle"       // waiting for a command, outside a transaction
+	StateMail       SessionState = "mail"       // waiting for a command, in a transaction
+	StateCommand    SessionState = "command"    // handling a command
+	StateData       SessionState = "data"       // receiving an e-mail and running the handler
+)
+
+// A SessionInfo is a snapshot of an active session. See Server.Sessions.
+type SessionInfo struct {
+	Session
+	State SessionState
+
+	// BytesRead and BytesWritten count the protocol traffic of the session,
+	// after decryption.
+	BytesRead, BytesWritten int64
+
+	// Duration is the time since the client connected, and StateDuration
+	// the time since the session entered State.
+	Duration, StateDuration time.Duration
+}
+
+type sessionKey struct{}
+
+// SessionFromContext returns the session of the connection a Handler was
+// called for, or nil if ctx does not carry one.
+func SessionFromContext(ctx context.Context) *Session {
+	session, _ := ctx.Value(sessionKey{}).(*Session)
+	return session
+}
+
+// sessionInfo returns a snapshot of the connection's session.
+func (c *conn) sessionInfo() Session {
+	session := c.session
+	session.TLS = c.tlsState()
+	return session
+}
+
+// context returns a context for calling out to the embedder, which carries
+// the session and is canceled when the connection closes.
+func (c *conn) context() context.Context {
+	session := c.sessionInfo()
+	return context.WithValue(c.ctx, sessionKey{}, &session)
+}
+
+// setState records what the session is doing for Server.Sessions, along
+// with the session as it is now. c.mu must be held.
+func (c *conn) setState(state SessionState) {
+	if state != c.status {
+		c.status, c.statusSince = state, c.server.now()
+	}
+	c.published = c.sessionInfo()
+}
+
+// info returns a snapshot of the session as of now.
+func (c *conn) info(now time.Time) SessionInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return SessionInfo{
+		Session:       c.published,
+		State:         c.status,
+		BytesRead:     c.bytesRead.Load(),
+		BytesWritten:  c.bytesWritten.Load(),
+		Duration:      now.Sub(c.started),
+		StateDuration: now.Sub(c.statusSince),
+	}
+}
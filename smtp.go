@@ -4,167 +4,791 @@
 package smtp
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"io"
+	"log/slog"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// A Mail holds a received e-mail. From and To are SMTP protocol-level fields
-// (and not parsed from the e-mail headers).
+// An Envelope holds the SMTP protocol-level fields of an e-mail, which are
+// not parsed from the e-mail headers.
+type Envelope struct {
+	// ID uniquely identifies the transaction, for tracing it across logs
+	// and storage. See WithIDGenerator.
+	ID string
+
+	// From is empty for the null reverse path, MAIL FROM:<>, which bounces
+	// and other automated replies use so that they are never bounced back.
+	From string
+	To   []string
+
+	// MailParams holds the ESMTP parameters of the MAIL command, such as
+	// SIZE, BODY and RET, and RcptParams those of the RCPT command of each
+	// recipient in To, such as NOTIFY and ORCPT. Keywords are upper-cased;
+	// values are as sent, and empty for parameters without a value. Commands
+	// with unknown or repeated parameters are refused.
+	MailParams map[string]string
+	RcptParams []map[string]string
+
+	// Received is when the server started receiving the e-mail's content.
+	Received time.Time
+
+	// Session describes the connection the e-mail was received on, as of
+	// the MAIL command. Its ID is shadowed by the transaction ID above.
+	Session
+}
+
+// A Mail holds a received e-mail.
 type Mail struct {
-	From, To string
-	Mail     string
+	Envelope
+	Mail string
 }
 
-// A Handler processes received e-mails. Should be thread-safe.
-type Handler func(*Mail)
+// A Handler processes received e-mails. Should be thread-safe. ctx carries
+// the Session (see SessionFromContext) and is canceled once the connection
+// is closed, including when the server is closed and when the client
+// disconnects before the handler returns.
+//
+// The client is told the e-mail was accepted only once the handler returns
+// nil. Returning an *SMTPError rejects it with that reply; any other error
+// is reported as a temporary failure, so the client will retry.
+type Handler func(ctx context.Context, m *Mail) error
+
+// A StreamHandler is like a Handler, but reads the e-mail from body while it
+// is being received instead of getting it in one piece. body yields the
+// e-mail with CRLF line endings and dot-stuffing undone; reading it fails if
+// the transfer breaks off, in which case the handler's result is ignored.
+// Anything the handler does not read is discarded. The handler must be done
+// with body when it returns: later reads fail.
+//
+// The server reads from the client only as the handler reads body, through a
+// fixed-size buffer, so a handler slower than the network throttles the
+// client through TCP flow control instead of piling up data in memory.
+type StreamHandler func(ctx context.Context, envelope *Envelope, body io.Reader) error
+
+// A ConnectHook is called for every new connection before the greeting.
+// ctx carries the Session, as for a Handler. Returning an *SMTPError refuses
+// the connection with that reply, and any other error with a 554 reply;
+// either way the connection is closed. Otherwise the hook returns ctx, nil
+// or a context derived from ctx, which becomes the parent of the contexts
+// passed to handlers and validators, so it can annotate the session with
+// values. A nil context keeps ctx.
+// The hook may also delay the greeting by waiting, to slow down suspicious
+// clients, but should give up when ctx is done.
+type ConnectHook func(ctx context.Context, remoteAddr net.Addr) (context.Context, error)
+
+// A SenderValidator checks the MAIL FROM address of each transaction. ctx
+// is like a Handler's; its Session tells whether and as whom the client
+// authenticated. Returning an *SMTPError rejects the sender with that reply;
+// any other error is reported as a temporary failure.
+type SenderValidator func(ctx context.Context, from string) error
+
+// A RecipientValidator checks each RCPT TO address before it is accepted,
+// so that unknown mailboxes are refused right away instead of after the
+// e-mail was received. ctx is like a Handler's. Returning an *SMTPError,
+// such as ErrMailboxUnavailable, rejects the recipient with that reply; any
+// other error is reported as a temporary failure.
+type RecipientValidator func(ctx context.Context, from, to string) error
 
-// SizeLimit is the maximum e-mail in bytes. Currently, package smtp does not support large e-mails.
+// A Middleware wraps a StreamHandler to add behavior around it, such as
+// logging or filtering. It may reject an e-mail without calling next. See
+// WithMiddleware.
+//
+// Middleware only sees e-mails being delivered, after DATA or BDAT. Policy
+// for earlier stages of a session goes in a ConnectHook, an Authenticator
+// or Mechanism, a SenderValidator or a RecipientValidator, which run in
+// that order.
+type Middleware func(next StreamHandler) StreamHandler
+
+// stream adapts h to a StreamHandler that buffers the whole e-mail.
+func (h Handler) stream() StreamHandler {
+	return func(ctx context.Context, envelope *Envelope, body io.Reader) error {
+		mail, err := io.ReadAll(body)
+		if err != nil {
+			return err
+		}
+		return h(ctx, &Mail{Envelope: *envelope, Mail: string(mail)})
+	}
+}
+
+// SizeLimit is the default maximum e-mail size in bytes. See
+// WithMaxMessageSize.
 const SizeLimit = 32 * 1024
 
-// MaxLineLength is the maximum length of a SMTP protocol line. Currently,
-// package smtp does not support long lines.
-const MaxLineLength = SizeLimit
+// MaxLineLength is the default maximum length of a SMTP protocol line, and
+// the size of each connection's read buffer; see WithReadBufferSize. It is
+// independent of the size limit: BDAT chunks are read through the buffer in
+// pieces, so only DATA lines need to fit in it.
+const MaxLineLength = 32 * 1024
 
 type conn struct {
-	domain string
+	server *Server
 
+	// conn is the underlying transport; all protocol I/O goes through wire
+	// and reader, which wrap it.
 	conn   io.ReadWriteCloser
+	rw     *deadlineConn
+	wire   io.ReadWriter // rw, or a transcript of it
 	reader *bufferedReader
+	tls    bool
 
-	handler Handler
+	log *slog.Logger
+
+	esmtp   bool // client greeted with EHLO
+	utf8    bool // client asked for SMTPUTF8 in its last MAIL command
+	session Session
+
+	ctx    context.Context
+	cancel context.CancelFunc
 
 	state    state
-	from, to string
+	envelope Envelope
+
+	// err is the first error writing to conn. Once set, the session ends.
+	err error
+
+	// mu guards idle and closed, and the transport while idle is set, for
+	// use by Server.Shutdown and Server.Close. It also guards the state
+	// published for Server.Sessions.
+	mu     sync.Mutex
+	idle   bool // waiting for the next command
+	closed bool
+
+	started     time.Time
+	status      SessionState
+	statusSince time.Time
+	published   Session
+
+	bytesRead, bytesWritten atomic.Int64
+}
+
+// setIdle marks whether the session is waiting for a command. It reports
+// false if the server closed the session in the meantime.
+func (c *conn) setIdle(idle bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return false
+	}
+	c.idle = idle
+	switch {
+	case !idle:
+		c.setState(StateCommand)
+	case c.state == initial:
+		c.setState(StateIdle)
+	default:
+		c.setState(StateMail)
+	}
+	return true
+}
+
+// closeIfIdle says goodbye to and closes a session that is waiting for a
+// command. A session in the middle of a command stays open; once it is
+// done it will find the server shutting down.
+func (c *conn) closeIfIdle() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.idle && !c.closed {
+		c.goodbye("421 " + c.server.domain + " shutting down\r\n")
+	}
+}
+
+// goodbye writes reply, if any, to an idle session and closes it. c.mu
+// must be held.
+func (c *conn) goodbye(reply string) {
+	if reply != "" {
+		// Write directly: the session's own goroutine owns c.err. Don't
+		// let a client that stopped reading hold up the caller.
+		if d, ok := c.conn.(deadliner); ok {
+			d.SetWriteDeadline(time.Now().Add(time.Second))
+		}
+		io.WriteString(c.conn, reply)
+	}
+	c.closed = true
+	c.conn.Close()
+	c.cancel()
+}
+
+func (c *conn) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	c.conn.Close()
+	c.cancel()
+}
+
+// setTransport switches the connection over to transport, discarding any
+// buffered input but keeping the timeouts.
+func (c *conn) setTransport(transport io.ReadWriteCloser) {
+	var rw deadlineConn
+	if c.rw != nil {
+		rw = *c.rw
+	}
+	rw.conn = transport
+
+	c.conn = transport
+	c.rw = &rw
+	c.wire = c.rw
+	if c.server.transcript {
+		c.wire = &transcript{rw: c.rw, log: c.log}
+	}
+	c.reader = newBufferedReader(c.wire, c.server.readBufferSize)
+}
+
+// handshake runs the TLS handshake within the command timeout, in a slot
+// taken with startHandshake.
+func (c *conn) handshake(tlsConn *tls.Conn) error {
+	defer c.server.endHandshake()
+	tlsConn.SetDeadline(c.rw.deadlineFor(c.server.commandTimeout))
+	defer tlsConn.SetDeadline(time.Time{})
+	if err := tlsConn.Handshake(); err != nil {
+		c.log.Info("tls handshake failed", "err", err)
+		return err
+	}
+	return nil
+}
+
+func (c *conn) write(reply string) {
+	if c.err != nil {
+		return
+	}
+	if _, err := io.WriteString(c.wire, reply); err != nil {
+		c.log.Debug("write failed", "err", err)
+		c.err = err
+	}
 }
 
 func (c *conn) greeting() {
-	c.conn.Write([]byte("220 " + c.domain + " jellevandenhooff/smtp ready!\r\n"))
+	c.write("220 " + c.server.domain + " jellevandenhooff/smtp ready!\r\n")
+}
+
+// refuse sends the reply for a connection the server won't talk to.
+func (c *conn) refuse(err error) {
+	var smtpErr *SMTPError
+	if errors.As(err, &smtpErr) {
+		c.reply(smtpErr)
+	} else {
+		c.write("554 " + c.server.domain + " no SMTP service here\r\n")
+	}
 }
 
 func (c *conn) ehlo() {
-	c.conn.Write([]byte("250-" + c.domain + "\r\n250-PIPELINING\r\n250-8BITMIME\r\n250-SMTPUTF8\r\n250-CHUNKING\r\n250 SIZE " + strconv.Itoa(SizeLimit) + "\r\n"))
+	extensions := "250-PIPELINING\r\n250-8BITMIME\r\n250-SMTPUTF8\r\n250-CHUNKING\r\n"
+	if c.server.tlsConfig != nil && !c.tls {
+		extensions += "250-STARTTLS\r\n"
+	}
+	if c.authAllowed() {
+		extensions += "250-AUTH " + c.mechanismNames() + "\r\n"
+	}
+	c.write("250-" + c.server.domain + "\r\n" + extensions + "250 SIZE " + strconv.Itoa(c.server.maxSize) + "\r\n")
 }
 
 func (c *conn) helo() {
-	c.conn.Write([]byte("250 " + c.domain + "\r\n"))
+	c.write("250 " + c.server.domain + "\r\n")
 }
 
 func (c *conn) syntaxError(message string) {
-	c.conn.Write([]byte("500 " + message + "\r\n"))
+	c.write("500 " + message + "\r\n")
 }
 
-func (c *conn) tooManyRecipients() {
-	c.conn.Write([]byte("451 only one recipient per mail, please\r\n"))
+// parseError replies to a command that could not be parsed.
+func (c *conn) parseError(err error) {
+	var smtpErr *SMTPError
+	if errors.As(err, &smtpErr) {
+		c.reply(smtpErr)
+		return
+	}
+	c.syntaxError(err.Error())
+}
+
+func (c *conn) lineTooLong() {
+	c.write("500 5.5.2 line too long\r\n")
 }
 
 func (c *conn) tooMuchMail() {
-	c.conn.Write([]byte("552 too much data\r\n"))
+	c.write("552 too much data\r\n")
+}
+
+func (c *conn) bareLineEnding() {
+	c.write("550 bare CR or LF in message, use CRLF\r\n")
 }
 
 func (c *conn) unexpectedCommand() {
-	c.conn.Write([]byte("503 did not expect that command\r\n"))
+	c.write("503 did not expect that command\r\n")
 }
 
 func (c *conn) ok() {
-	c.conn.Write([]byte("250 ok\r\n"))
+	c.write("250 ok\r\n")
 }
 
 func (c *conn) quitOk() {
-	c.conn.Write([]byte("221 ok\r\n"))
+	c.write("221 ok\r\n")
 }
 
 func (c *conn) weDontVerify() {
-	c.conn.Write([]byte("252 vrfy is so 90s\r\n"))
+	c.write("252 vrfy is so 90s\r\n")
+}
+
+func (c *conn) readyForTLS() {
+	c.write("220 ready to start TLS\r\n")
+}
+
+func (c *conn) tlsNotAvailable() {
+	c.write("454 TLS not available\r\n")
+}
+
+func (c *conn) tooManyHandshakes() {
+	c.write("454 4.7.0 TLS not available due to temporary reason\r\n")
+}
+
+func (c *conn) encryptionRequired() {
+	c.write("538 5.7.11 encryption required for authentication\r\n")
+}
+
+func (c *conn) unsupportedMechanism() {
+	c.write("504 5.5.4 unrecognized authentication type\r\n")
+}
+
+func (c *conn) authSucceeded() {
+	c.write("235 2.7.0 authentication successful\r\n")
+}
+
+func (c *conn) authCancelled() {
+	c.write("501 5.0.0 authentication cancelled\r\n")
+}
+
+func (c *conn) badBase64() {
+	c.write("501 5.5.2 cannot decode response\r\n")
+}
+
+func (c *conn) reply(err *SMTPError) {
+	c.write(replyText(err.Error(), c.utf8) + "\r\n")
+}
+
+// replyText makes text safe to send in a reply line. Control characters,
+// which could break up the reply, become spaces. Non-ASCII characters are
+// only allowed once the client asked for SMTPUTF8 (RFC 6531), and become
+// question marks otherwise.
+func replyText(text string, utf8 bool) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return ' '
+		}
+		if r > 0x7e && !utf8 {
+			return '?'
+		}
+		return r
+	}, text)
+}
+
+// replyError rejects a command with err if it is an *SMTPError, or with a
+// temporary failure otherwise.
+func (c *conn) replyError(err error) {
+	var smtpErr *SMTPError
+	if errors.As(err, &smtpErr) {
+		c.reply(smtpErr)
+	} else {
+		c.log.Error("temporary failure", "err", err)
+		c.reply(ErrTempFail)
+	}
+}
+
+func (c *conn) timedOut() {
+	c.log.Info("timed out")
+	c.rw.deadline = time.Time{} // let the goodbye through
+	c.write("421 4.4.2 " + c.server.domain + " timeout, closing connection\r\n")
+}
+
+func (c *conn) shuttingDown() {
+	c.write("421 " + c.server.domain + " shutting down\r\n")
 }
 
 func (c *conn) startMail() {
-	c.conn.Write([]byte("354 here we go\r\n"))
+	c.write("354 here we go\r\n")
 }
 
-func (c *conn) readData() (string, bool) {
-	c.startMail()
+var (
+	errTooMuchMail    = errors.New("too much mail")
+	errBareLineEnding = errors.New("bare CR or LF")
+)
 
-	var lines []string
-	length := 0
+var (
+	errTooManyRecipients = &SMTPError{Code: 452, Enhanced: "4.5.3", Message: "too many recipients"}
+	errSizeExceeded      = &SMTPError{Code: 552, Enhanced: "5.3.4", Message: "message size exceeds fixed maximum message size"}
+	errBadSize           = &SMTPError{Code: 501, Enhanced: "5.5.4", Message: "bad SIZE parameter"}
+)
 
-	for {
-		line, err := c.reader.ReadLine()
+// A body streams the content of a DATA or BDAT transfer to the handler.
+// failure returns the error that broke off the transfer, if any; it has
+// not been reported to the client yet.
+type body interface {
+	io.Reader
+	failure() error
+}
+
+// dataReader reads a DATA transfer up to the terminating dot, undoing
+// dot-stuffing.
+type dataReader struct {
+	c      *conn
+	line   []byte // rest of the current line, including CRLF
+	length int
+	done   bool
+	err    error
+}
+
+func (r *dataReader) Read(p []byte) (int, error) {
+	for len(r.line) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.done {
+			return 0, io.EOF
+		}
+
+		line, err := r.c.reader.ReadLine()
+		if err == errLineTooLong {
+			r.err = r.skip()
+			continue
+		}
 		if err != nil {
-			return "", false
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			r.err = err
+			continue
 		}
 		if line == "." {
-			break
+			r.done = true
+			continue
+		}
+		// Only CRLF.CRLF ends DATA. Refuse bare CRs and LFs instead of passing
+		// them on, so that a sloppier server downstream cannot be tricked into
+		// seeing an end-of-data sequence that we did not.
+		if strings.ContainsAny(line, "\r\n") {
+			r.err = errBareLineEnding
+			continue
 		}
 		line = strings.TrimPrefix(line, ".")
 
-		length += len(line) + 2
-		if length > SizeLimit {
-			c.tooMuchMail()
-			return "", false
+		r.length += len(line) + 2
+		if max := r.c.server.maxSize; max > 0 && r.length > max {
+			r.err = errTooMuchMail
+			continue
 		}
-		lines = append(lines, line)
+		r.line = append(append(r.line[:0], line...), "\r\n"...)
 	}
 
-	lines = append(lines, "") // include final CRLF
-	email := strings.Join(lines, "\r\n")
-	c.ok()
-
-	return email, true
+	n := copy(p, r.line)
+	r.line = r.line[n:]
+	return n, nil
 }
 
-func (c *conn) readNextBdat() (*bdatCmd, bool) {
+// skip discards the rest of an e-mail holding a line that was too long,
+// so that the session can go on after refusing it. It returns
+// errLineTooLong once it reached the terminating dot.
+func (r *dataReader) skip() error {
 	for {
+		line, err := r.c.reader.ReadLine()
+		if err == errLineTooLong {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if line == "." {
+			return errLineTooLong
+		}
+	}
+}
+
+func (r *dataReader) failure() error {
+	return r.err
+}
+
+func (c *conn) readNextBdat() (*bdatCmd, error) {
+	for c.err == nil {
 		line, err := c.reader.ReadLine()
+		if err == errLineTooLong {
+			c.lineTooLong()
+			continue
+		}
 		if err != nil {
-			return nil, false
+			return nil, err
 		}
 		cmd, err := parseCommand(line)
 		if err != nil {
-			c.syntaxError(err.Error())
+			c.parseError(err)
 			continue
 		}
 		switch cmd := cmd.(type) {
 		case *bdatCmd:
-			return cmd, true
+			return cmd, nil
 		default:
 			c.unexpectedCommand()
 		}
 	}
+	return nil, c.err
 }
 
-func (c *conn) readBdat(cmd *bdatCmd) (string, bool) {
-	var data [][]byte
-	length := 0
+// bdatReader reads a series of BDAT chunks, acknowledging each chunk
+// once it has been read.
+type bdatReader struct {
+	c         *conn
+	remaining int // in the current chunk
+	last      bool
+	length    int
+	err       error
+}
 
-	for {
-		length += cmd.length
-		if length > SizeLimit {
-			c.tooMuchMail()
-			return "", false
+func newBdatReader(c *conn, cmd *bdatCmd) *bdatReader {
+	r := &bdatReader{c: c}
+	r.start(cmd)
+	return r
+}
+
+func (r *bdatReader) start(cmd *bdatCmd) {
+	// Check the declared chunk length before reading anything. Comparing
+	// against the remaining budget avoids overflowing length on absurd
+	// declarations. The chunk is not drained; the connection is closed
+	// after replying instead.
+	if max := r.c.server.maxSize; max > 0 && cmd.length > max-r.length {
+		r.err = errTooMuchMail
+		return
+	}
+	r.length += cmd.length
+	r.remaining, r.last = cmd.length, cmd.last
+}
+
+func (r *bdatReader) Read(p []byte) (int, error) {
+	for r.remaining == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.last {
+			return 0, io.EOF
 		}
 
-		slice := make([]byte, cmd.length)
-		if _, err := io.ReadFull(c.reader, slice); err != nil {
-			return "", false
+		r.c.ok() // acknowledge the chunk
+		cmd, err := r.c.readNextBdat()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			r.err = err
+			continue
 		}
-		data = append(data, slice)
+		r.start(cmd)
+	}
 
-		if cmd.last {
-			break
+	if len(p) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.c.reader.Read(p)
+	r.remaining -= n
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
 		}
+		r.err = err
+		if n == 0 {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+func (r *bdatReader) failure() error {
+	return r.err
+}
+
+// deliver passes a message to the handler as it arrives, reads whatever
+// the handler left unread, and replies with the handler's verdict. It
+// returns false if the session should end.
+func (c *conn) deliver(body body) bool {
+	c.mu.Lock()
+	c.setState(StateData)
+	c.mu.Unlock()
+
+	c.rw.budgeted, c.rw.budget = c.server.transferTimeout > 0, c.server.transferTimeout
+	c.rw.readTimeout = c.server.dataTimeout
+	envelope := c.envelope
+	envelope.Received = c.server.now()
+	var content io.Reader = body
+	if c.server.receivedHost != "" {
+		content = io.MultiReader(strings.NewReader(c.receivedHeader(&envelope)), body)
+	}
+	var err error
+	if c.server.ackFirst {
+		// Receive the whole e-mail before replying; failures are reported
+		// by body.
+		data, _ := io.ReadAll(content)
+		content = bytes.NewReader(data)
+	} else {
+		ctx, cancel := context.WithCancel(c.context())
+		watcher := &disconnectWatcher{c: c, cancel: cancel, content: content}
+		err = c.server.handler(ctx, &envelope, watcher)
+		watcher.stop()
+		cancel()
+	}
+	io.Copy(io.Discard, body)
+	c.state, c.envelope = initial, Envelope{}
+	c.rw.readTimeout = c.server.commandTimeout
+	c.rw.budgeted = false
+
+	failure := body.failure()
+	if !c.server.ackFirst {
+		if failure != nil {
+			c.server.delivered(&envelope, failure)
+		} else {
+			c.server.delivered(&envelope, err)
+		}
+	}
+	if isTimeout(failure) {
+		c.timedOut()
+		return false
+	}
+	switch failure {
+	case nil:
+	case errLineTooLong:
+		c.emit(EventRejected, &envelope, failure)
+		c.lineTooLong()
+		return true
+	case errTooMuchMail:
+		c.emit(EventRejected, &envelope, failure)
+		c.tooMuchMail()
+		return false
+	case errBareLineEnding:
+		c.emit(EventRejected, &envelope, failure)
+		c.bareLineEnding()
+		return false
+	default:
+		return false
+	}
+
+	if c.server.ackFirst {
+		c.emit(EventAccepted, &envelope, nil)
+		c.ok()
+		c.handleAccepted(&envelope, content)
+		return true
+	}
+
+	if err == nil {
+		c.emit(EventAccepted, &envelope, nil)
+	} else {
+		c.emit(EventRejected, &envelope, err)
+	}
+
+	if err == nil {
+		c.ok()
+	} else {
+		c.replyError(err)
+	}
+	return true
+}
+
+// errBodyClosed is returned by reads of an e-mail after its handler
+// returned.
+var errBodyClosed = errors.New("smtp: read of e-mail after handler returned")
+
+// A disconnectWatcher passes an e-mail to a handler, and cancels the
+// handler's context if the client hangs up while the handler runs. Once the
+// handler has read the whole e-mail, the connection is idle until the
+// reply, so a background read can watch it without taking anything away
+// from the session: whatever it reads is kept in the read buffer.
+//
+// Reads are serialized and fail once the handler returned, so that a
+// handler reading from other goroutines cannot race with the session or
+// the watch.
+type disconnectWatcher struct {
+	c       *conn
+	cancel  context.CancelFunc
+	content io.Reader
+
+	mu       sync.Mutex
+	done     chan struct{} // set while watching
+	returned bool
+}
+
+// Read reads the e-mail, watching the connection once it has been read to
+// the end.
+func (w *disconnectWatcher) Read(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.returned {
+		return 0, errBodyClosed
+	}
+	n, err := w.content.Read(p)
+	if err == io.EOF && w.done == nil {
+		w.start()
+	}
+	return n, err
+}
 
-		var ok bool
-		cmd, ok = c.readNextBdat()
-		if !ok {
-			return "", false
+// start starts the watch. w.mu must be held.
+func (w *disconnectWatcher) start() {
+	c := w.c
+	d, ok := c.conn.(deadliner)
+	if !ok {
+		return // the watch could not be stopped
+	}
+	c.rw.paused = true
+	d.SetReadDeadline(c.rw.deadline)
+	w.done = make(chan struct{})
+	go func() {
+		defer close(w.done)
+		err := c.reader.Fill()
+		if err != nil && err != bufio.ErrBufferFull && !isTimeout(err) {
+			c.log.Debug("client disconnected while handling e-mail", "err", err)
+			w.cancel()
 		}
+	}()
+}
+
+// stop ends the watch, interrupting the background read, once the handler
+// returned.
+func (w *disconnectWatcher) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.returned = true
+	if w.done == nil {
+		return
 	}
+	w.c.conn.(deadliner).SetReadDeadline(time.Unix(1, 0))
+	<-w.done
+	w.c.rw.paused = false
+}
 
-	c.ok()
-	return string(bytes.Join(data, nil)), true
+// handleAccepted passes an e-mail the client was already told was accepted
+// to the handler in the background. See WithAckBeforeHandler.
+func (c *conn) handleAccepted(envelope *Envelope, content io.Reader) {
+	ctx := context.WithoutCancel(c.context())
+	log := c.log.With("id", envelope.ID)
+	c.server.pending.Add(1)
+	go func() {
+		defer c.server.pending.Done()
+		err := c.server.handler(ctx, envelope, content)
+		if err != nil {
+			log.Error("handler failed after accepting e-mail", "err", err)
+		}
+		c.server.delivered(envelope, err)
+	}()
 }
 
 type state int
@@ -183,6 +807,8 @@ func (c *conn) processCommand(cmd interface{}) bool {
 			c.unexpectedCommand()
 			return true
 		}
+		c.esmtp = cmd.isEhlo
+		c.session.Helo = cmd.domain
 		if cmd.isEhlo {
 			c.ehlo()
 		} else {
@@ -195,16 +821,54 @@ func (c *conn) processCommand(cmd interface{}) bool {
 			c.unexpectedCommand()
 			return true
 		}
-		c.state, c.from = gotFrom, cmd.from
+		_, c.utf8 = cmd.params["SMTPUTF8"]
+		if size, ok := cmd.params["SIZE"]; ok {
+			// Sizes beyond int64 are valid, and parse as the largest one.
+			n, err := strconv.ParseInt(size, 10, 64)
+			if (err != nil && !errors.Is(err, strconv.ErrRange)) || n < 0 {
+				c.reply(errBadSize)
+				return true
+			}
+			// RFC 1870: refuse e-mails that won't fit before they are sent.
+			if c.server.maxSize > 0 && n > int64(c.server.maxSize) {
+				c.emit(EventRejected, nil, errSizeExceeded)
+				c.reply(errSizeExceeded)
+				return true
+			}
+		}
+		if c.server.validateSender != nil {
+			if err := c.server.validateSender(c.context(), cmd.from); err != nil {
+				c.emit(EventRejected, nil, err)
+				c.replyError(err)
+				return true
+			}
+		}
+		c.state, c.envelope.From = gotFrom, cmd.from
+		c.envelope.MailParams = cmd.params
+		c.envelope.ID = c.server.newID()
+		c.envelope.Session = c.sessionInfo()
 		c.ok()
 		return true
 
 	case *rcptToCmd:
-		if c.state != gotFrom {
+		if c.state != gotFrom && c.state != gotTo {
 			c.unexpectedCommand()
 			return true
 		}
-		c.state, c.to = gotTo, cmd.to
+		if c.server.maxRecipients > 0 && len(c.envelope.To) >= c.server.maxRecipients {
+			c.emit(EventRejected, &c.envelope, errTooManyRecipients)
+			c.reply(errTooManyRecipients)
+			return true
+		}
+		if c.server.validateRecipient != nil {
+			if err := c.server.validateRecipient(c.context(), c.envelope.From, cmd.to); err != nil {
+				c.emit(EventRejected, &c.envelope, err)
+				c.replyError(err)
+				return true
+			}
+		}
+		c.state, c.envelope.To = gotTo, append(c.envelope.To, cmd.to)
+		c.envelope.RcptParams = append(c.envelope.RcptParams, cmd.params)
 		c.ok()
 		return true
 
@@ -213,29 +877,39 @@ func (c *conn) processCommand(cmd interface{}) bool {
 			c.unexpectedCommand()
 			return true
 		}
-		mail, ok := c.readBdat(cmd)
-		if !ok {
+		body := newBdatReader(c, cmd)
+		if body.err != nil {
+			// The first chunk alone is too large; spare the handler.
+			c.emit(EventRejected, &c.envelope, body.err)
+			c.state, c.envelope = initial, Envelope{}
+			c.tooMuchMail()
 			return false
 		}
-		c.handler(&Mail{From: c.from, To: c.to, Mail: mail})
-		c.state, c.from, c.to = initial, "", ""
-		return true
+		return c.deliver(body)
 
 	case *dataCmd:
 		if c.state != gotTo {
 			c.unexpectedCommand()
 			return true
 		}
-		mail, ok := c.readData()
-		if !ok {
+		c.startMail()
+		if c.err != nil {
 			return false
 		}
-		c.handler(&Mail{From: c.from, To: c.to, Mail: mail})
-		c.state, c.from, c.to = initial, "", ""
-		return true
+		return c.deliver(&dataReader{c: c})
+
+	case *authCmd:
+		return c.auth(cmd)
+
+	case *starttlsCmd:
+		if c.state != initial || c.tls {
+			c.unexpectedCommand()
+			return true
+		}
+		return c.startTLS()
 
 	case *rsetCmd:
-		c.state, c.from, c.to = initial, "", ""
+		c.state, c.envelope = initial, Envelope{}
 		c.ok()
 		return true
 
@@ -257,20 +931,97 @@ func (c *conn) processCommand(cmd interface{}) bool {
 	}
 }
 
+// startTLS upgrades the connection after a STARTTLS command. Any commands
+// pipelined after STARTTLS are discarded with the old reader.
+func (c *conn) startTLS() bool {
+	nc, ok := c.conn.(net.Conn)
+	if c.server.tlsConfig == nil || !ok {
+		c.tlsNotAvailable()
+		return true
+	}
+	if !c.server.startHandshake() {
+		c.log.Info("too many tls handshakes")
+		c.tooManyHandshakes()
+		return true
+	}
+	c.readyForTLS()
+	if c.err != nil {
+		c.server.endHandshake()
+		return false
+	}
+
+	tlsConn := tls.Server(nc, c.server.tlsConfig)
+	if err := c.handshake(tlsConn); err != nil {
+		return false
+	}
+
+	// RFC 3207: the client must start over after the handshake.
+	c.mu.Lock()
+	c.setTransport(tlsConn)
+	c.mu.Unlock()
+	c.tls, c.esmtp = true, false
+	c.session.Helo, c.session.User = "", ""
+	c.state, c.envelope = initial, Envelope{}
+	return true
+}
+
 func (c *conn) handle() {
-	c.greeting()
-	defer c.conn.Close()
+	defer c.server.trackConn(c, false)
+	defer c.close()
 
+	if tlsConn, ok := c.conn.(*tls.Conn); ok {
+		if !c.server.startHandshake() {
+			c.log.Info("too many tls handshakes")
+			return
+		}
+		if err := c.handshake(tlsConn); err != nil {
+			return
+		}
+	}
+	c.log.Debug("connected")
+	defer c.log.Debug("disconnected")
+	c.emit(EventConnect, nil, nil)
+	defer c.emit(EventDisconnect, nil, nil)
+	if c.server.onConnect != nil {
+		ctx, err := c.server.onConnect(c.context(), c.session.RemoteAddr)
+		if err != nil {
+			c.emit(EventRejected, nil, err)
+			c.refuse(err)
+			return
+		}
+		if ctx != nil {
+			c.ctx = ctx
+		}
+	}
+	c.greeting()
 	c.state = initial
 
-	for {
+	for c.err == nil {
+		if !c.setIdle(true) {
+			break
+		}
+		if c.server.closed() {
+			c.shuttingDown()
+			break
+		}
 		line, err := c.reader.ReadLine()
+		if !c.setIdle(false) {
+			break
+		}
+		if err == errLineTooLong {
+			c.lineTooLong()
+			continue
+		}
+		if isTimeout(err) {
+			c.timedOut()
+			break
+		}
 		if err != nil {
 			break
 		}
 		cmd, err := parseCommand(line)
 		if err != nil {
-			c.syntaxError(err.Error())
+			c.parseError(err)
 			continue
 		}
 
@@ -283,19 +1034,11 @@ func (c *conn) handle() {
 // Serve runs an SMTP server. Prints domain on connection. Returns an error if
 // the listener fails.
 func Serve(domain string, listener net.Listener, handler Handler) error {
-	for {
-		var c io.ReadWriteCloser
-		c, err := listener.Accept()
-		if err != nil {
-			return err
-		}
+	return NewServer(domain, handler).Serve(listener)
+}
 
-		conn := &conn{
-			domain:  domain,
-			conn:    c,
-			reader:  newBufferedReader(c, MaxLineLength),
-			handler: handler,
-		}
-		go conn.handle()
-	}
+// ServeTLS runs an SMTP server that speaks TLS from the first byte on, as on
+// submission port 465. Returns an error if the listener fails.
+func ServeTLS(domain string, listener net.Listener, config *tls.Config, handler Handler) error {
+	return NewServer(domain, handler, WithTLSConfig(config)).ServeTLS(listener)
 }
@@ -0,0 +1,638 @@
+package smtp
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"math/big"
+	"net"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// converse runs a session of s over a pipe, sends input, and returns the
+// server's reply lines until it closes the connection.
+func converse(t *testing.T, s *Server, input string) []string {
+	t.Helper()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	go s.newConn(server, false).handle()
+	go io.WriteString(client, input)
+
+	var replies []string
+	r := bufio.NewReader(client)
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			return replies
+		}
+		if err != nil {
+			t.Fatalf("reading replies %q: %v", replies, err)
+		}
+		replies = append(replies, strings.TrimSuffix(line, "\r\n"))
+	}
+}
+
+// testTLSConfig returns a server config with a fresh self-signed
+// certificate.
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// A testClient talks to a session of a server over a pipe, one command at a
+// time.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dial starts a session of s and reads its greeting.
+func dial(t *testing.T, s *Server) *testClient {
+	t.Helper()
+
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	go s.newConn(server, false).handle()
+
+	c := &testClient{t: t, conn: client, r: bufio.NewReader(client)}
+	c.reply()
+	return c
+}
+
+// reply reads a reply, returning its lines.
+func (c *testClient) reply() []string {
+	c.t.Helper()
+
+	var lines []string
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("reading reply %q: %v", lines, err)
+		}
+		line = strings.TrimSuffix(line, "\r\n")
+		lines = append(lines, line)
+		if len(line) < 4 || line[3] != '-' {
+			return lines
+		}
+	}
+}
+
+// cmd sends a command and returns the last line of the reply.
+func (c *testClient) cmd(command string) string {
+	c.t.Helper()
+
+	if _, err := io.WriteString(c.conn, command+"\r\n"); err != nil {
+		c.t.Fatalf("sending %q: %v", command, err)
+	}
+	lines := c.reply()
+	return lines[len(lines)-1]
+}
+
+// startTLS runs the TLS handshake after the server agreed to STARTTLS.
+func (c *testClient) startTLS() {
+	c.t.Helper()
+
+	tlsConn := tls.Client(c.conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		c.t.Fatal(err)
+	}
+	c.conn, c.r = tlsConn, bufio.NewReader(tlsConn)
+}
+
+func TestSmuggling(t *testing.T) {
+	for _, ending := range []string{
+		"\n.\n",
+		"\n.\r\n",
+		"\r\n.\n",
+		"\r.\r",
+		"\r\n.\r\r\n",
+	} {
+		var called atomic.Bool
+		s := NewServer("test", func(ctx context.Context, m *Mail) error {
+			called.Store(true)
+			return nil
+		})
+
+		replies := converse(t, s, "EHLO client\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.com>\r\nDATA\r\n"+
+			"Subject: hi\r\n\r\nhello"+ending+
+			"MAIL FROM:<evil@example.com>\r\nRCPT TO:<b@example.com>\r\nDATA\r\nsmuggled\r\n.\r\nQUIT\r\n")
+
+		last := replies[len(replies)-1]
+		if !strings.HasPrefix(last, "550 ") {
+			t.Errorf("ending %q: got replies %q, want 550 last", ending, replies)
+		}
+		if called.Load() {
+			t.Errorf("ending %q: handler called", ending)
+		}
+	}
+}
+
+func TestBareLineEndingInCommand(t *testing.T) {
+	s := NewServer("test", func(ctx context.Context, m *Mail) error {
+		return nil
+	})
+
+	replies := converse(t, s, "EHLO client\r\nMAIL FROM:<a@example.com>\nRCPT TO:<b@example.com>\r\nRSET\rNOOP\r\nQUIT\r\n")
+	want := []string{"501 5.5.2 bare CR or LF in command", "501 5.5.2 bare CR or LF in command", "221 ok"}
+	got := replies[len(replies)-3:]
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got replies %q, want them to end in %q", replies, want)
+		}
+	}
+}
+
+func TestControlCharacters(t *testing.T) {
+	for _, tc := range []struct {
+		command, reply string
+	}{
+		{"EHLO evil\nBcc: victim@example.com", "501 5.5.2 bare CR or LF in command"},
+		{"RCPT TO:<b@example.com\nX-Injected:1>", "501 5.5.2 bare CR or LF in command"},
+		{"EHLO evil\x00Bcc: victim@example.com", "501 5.5.2 control character in domain"},
+		{"HELO evil\tx", "501 5.5.2 control character in domain"},
+		{"MAIL FROM:<a\x1b@example.com>", "501 5.1.3 control character in address"},
+		{"RCPT TO:<b@example.com\x7f>", "501 5.1.3 control character in address"},
+	} {
+		s := NewServer("test", func(ctx context.Context, m *Mail) error {
+			return nil
+		})
+
+		replies := converse(t, s, "EHLO client\r\nMAIL FROM:<a@example.com>\r\n"+tc.command+"\r\nQUIT\r\n")
+		if got := replies[len(replies)-2]; got != tc.reply {
+			t.Errorf("%q: got reply %q, want %q", tc.command, got, tc.reply)
+		}
+	}
+}
+
+func TestNullReversePath(t *testing.T) {
+	var got *Mail
+	s := NewServer("test", func(ctx context.Context, m *Mail) error {
+		got = m
+		return nil
+	})
+
+	replies := converse(t, s, "EHLO mailer-daemon.example.com\r\nMAIL FROM:<>\r\nRCPT TO:<a@example.com>\r\nDATA\r\n"+
+		"Subject: Undelivered Mail Returned to Sender\r\n\r\nbounce\r\n.\r\nQUIT\r\n")
+	if got == nil {
+		t.Fatalf("handler not called, replies %q", replies)
+	}
+	if got.From != "" || !reflect.DeepEqual(got.To, []string{"a@example.com"}) {
+		t.Errorf("got envelope from %q to %q, want null sender to a@example.com", got.From, got.To)
+	}
+}
+
+func TestNullRecipient(t *testing.T) {
+	s := NewServer("test", func(ctx context.Context, m *Mail) error {
+		return nil
+	})
+
+	replies := converse(t, s, "EHLO client\r\nMAIL FROM:<>\r\nRCPT TO:<>\r\nDATA\r\nQUIT\r\n")
+	want := []string{"250 ok", "500 missing recipient", "503 did not expect that command", "221 ok"}
+	if got := replies[len(replies)-4:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got replies %q, want them to end in %q", replies, want)
+	}
+}
+
+func TestReadBufferSize(t *testing.T) {
+	s := NewServer("test", func(ctx context.Context, m *Mail) error {
+		return nil
+	}, WithReadBufferSize(10))
+
+	// The buffer is raised to the minimum, which fits a 998 byte line and
+	// its CRLF.
+	fits := "NOOP " + strings.Repeat("x", 993)
+	replies := converse(t, s, fits+"\r\n"+fits+"x\r\nQUIT\r\n")
+	want := []string{"250 ok", "500 5.5.2 line too long", "221 ok"}
+	if got := replies[1:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got replies %q, want %q", got, want)
+	}
+}
+
+func TestTransferTimeoutSlowHandler(t *testing.T) {
+	s := NewServer("test", nil, WithStreamHandler(func(ctx context.Context, envelope *Envelope, body io.Reader) error {
+		buf := make([]byte, 8)
+		for {
+			time.Sleep(50 * time.Millisecond)
+			if _, err := body.Read(buf); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+	}), WithTransferTimeout(100*time.Millisecond))
+
+	// The handler takes well over the transfer timeout to read the e-mail,
+	// but the client is never kept waiting.
+	replies := converse(t, s, "EHLO client\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.com>\r\nDATA\r\n"+
+		"Subject: hi\r\n\r\nhello, world\r\n.\r\nQUIT\r\n")
+	want := []string{"354 here we go", "250 ok", "221 ok"}
+	if got := replies[len(replies)-3:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got replies %q, want them to end in %q", replies, want)
+	}
+}
+
+func TestTransferTimeoutTrickle(t *testing.T) {
+	s := NewServer("test", func(ctx context.Context, m *Mail) error {
+		return nil
+	}, WithTransferTimeout(200*time.Millisecond))
+
+	client, server := net.Pipe()
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	go s.newConn(server, false).handle()
+	go func() {
+		io.WriteString(client, "EHLO client\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.com>\r\nDATA\r\n")
+		for {
+			time.Sleep(20 * time.Millisecond)
+			if _, err := io.WriteString(client, "x\r\n"); err != nil {
+				return
+			}
+		}
+	}()
+
+	var last string
+	r := bufio.NewReader(client)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			break
+		}
+		last = line
+	}
+	if !strings.HasPrefix(last, "421 4.4.2 ") {
+		t.Errorf("got last reply %q, want 421 4.4.2", last)
+	}
+}
+
+func TestMaxRecipients(t *testing.T) {
+	for _, tc := range []struct {
+		max  int
+		want string
+	}{
+		{1, "452 4.5.3 too many recipients"},
+		{0, "250 ok"},
+	} {
+		s := NewServer("test", func(ctx context.Context, m *Mail) error {
+			return nil
+		}, WithMaxRecipients(tc.max))
+
+		replies := converse(t, s, "EHLO client\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.com>\r\nRCPT TO:<c@example.com>\r\nQUIT\r\n")
+		if got := replies[len(replies)-2]; got != tc.want {
+			t.Errorf("max %d: got reply %q to second recipient, want %q", tc.max, got, tc.want)
+		}
+	}
+}
+
+func TestHandlerContextCanceledOnDisconnect(t *testing.T) {
+	canceled := make(chan bool, 1)
+	s := NewServer("test", func(ctx context.Context, m *Mail) error {
+		select {
+		case <-ctx.Done():
+			canceled <- true
+		case <-time.After(2 * time.Second):
+			canceled <- false
+		}
+		return nil
+	})
+
+	client, server := net.Pipe()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	go s.newConn(server, false).handle()
+	go io.WriteString(client, "EHLO client\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.com>\r\nDATA\r\n")
+	r := bufio.NewReader(client)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, "354 ") {
+			break
+		}
+	}
+	io.WriteString(client, "hello\r\n.\r\n")
+	client.Close()
+
+	if !<-canceled {
+		t.Error("handler context not canceled after client disconnected")
+	}
+}
+
+func TestCommandDuringHandler(t *testing.T) {
+	// A command the client pipelines while the handler runs, as it may
+	// after BDAT LAST, must survive the disconnect watch.
+	received := make(chan bool)
+	s := NewServer("test", func(ctx context.Context, m *Mail) error {
+		received <- true
+		time.Sleep(50 * time.Millisecond)
+		if ctx.Err() != nil {
+			t.Error("handler context canceled")
+		}
+		return nil
+	})
+
+	client, server := net.Pipe()
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	go s.newConn(server, false).handle()
+	go func() {
+		io.WriteString(client, "EHLO client\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.com>\r\nBDAT 5 LAST\r\nhello")
+		<-received
+		io.WriteString(client, "QUIT\r\n")
+	}()
+
+	var replies []string
+	r := bufio.NewReader(client)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			break
+		}
+		replies = append(replies, strings.TrimSuffix(line, "\r\n"))
+	}
+	want := []string{"250 ok", "221 ok"}
+	if got := replies[len(replies)-2:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got replies %q, want them to end in %q", replies, want)
+	}
+}
+
+func TestStartTLSDiscardsPipelinedCommands(t *testing.T) {
+	s := NewServer("test", func(ctx context.Context, m *Mail) error {
+		return nil
+	}, WithTLSConfig(testTLSConfig(t)))
+	c := dial(t, s)
+
+	// A man in the middle can append plaintext commands to STARTTLS
+	// (CVE-2011-0411); they must not be run inside the TLS session.
+	go io.WriteString(c.conn, "EHLO client\r\nSTARTTLS\r\nMAIL FROM:<evil@example.com>\r\n")
+	c.reply()
+	if got, want := c.reply()[0], "220 ready to start TLS"; got != want {
+		t.Fatalf("STARTTLS: got %q, want %q", got, want)
+	}
+	c.startTLS()
+
+	for _, step := range []struct {
+		command, want string
+	}{
+		{"RCPT TO:<b@example.com>", "503 did not expect that command"},
+		{"EHLO client", "250 SIZE 32768"},
+		{"MAIL FROM:<a@example.com>", "250 ok"},
+	} {
+		if got := c.cmd(step.command); got != step.want {
+			t.Errorf("%s: got %q, want %q", step.command, got, step.want)
+		}
+	}
+}
+
+func TestStartTLSResetsSession(t *testing.T) {
+	var got *Mail
+	s := NewServer("test", func(ctx context.Context, m *Mail) error {
+		got = m
+		return nil
+	}, WithTLSConfig(testTLSConfig(t)))
+	c := dial(t, s)
+
+	io.WriteString(c.conn, "EHLO before\r\n")
+	if ehlo := strings.Join(c.reply(), "\n"); !strings.Contains(ehlo, "250-STARTTLS") {
+		t.Errorf("STARTTLS not offered: %q", ehlo)
+	}
+	for _, step := range []struct {
+		command, want string
+	}{
+		{"MAIL FROM:<a@example.com>", "250 ok"},
+		{"STARTTLS", "503 did not expect that command"}, // in a transaction
+		{"RSET", "250 ok"},
+		{"STARTTLS", "220 ready to start TLS"},
+	} {
+		if got := c.cmd(step.command); got != step.want {
+			t.Fatalf("%s: got %q, want %q", step.command, got, step.want)
+		}
+	}
+	c.startTLS()
+
+	io.WriteString(c.conn, "EHLO after\r\n")
+	if ehlo := strings.Join(c.reply(), "\n"); strings.Contains(ehlo, "STARTTLS") {
+		t.Errorf("STARTTLS offered again: %q", ehlo)
+	}
+	for _, step := range []struct {
+		command, want string
+	}{
+		{"STARTTLS", "503 did not expect that command"},
+		{"MAIL FROM:<a@example.com>", "250 ok"},
+		{"RCPT TO:<b@example.com>", "250 ok"},
+		{"DATA", "354 here we go"},
+		{"hello\r\n.", "250 ok"},
+	} {
+		if got := c.cmd(step.command); got != step.want {
+			t.Fatalf("%s: got %q, want %q", step.command, got, step.want)
+		}
+	}
+	if got.Helo != "after" || got.TLS == nil {
+		t.Errorf("got helo %q and TLS state %v, want after and TLS", got.Helo, got.TLS)
+	}
+}
+
+func TestStartTLSNotConfigured(t *testing.T) {
+	s := NewServer("test", func(ctx context.Context, m *Mail) error {
+		return nil
+	})
+	c := dial(t, s)
+
+	io.WriteString(c.conn, "EHLO client\r\n")
+	if ehlo := strings.Join(c.reply(), "\n"); strings.Contains(ehlo, "STARTTLS") {
+		t.Errorf("STARTTLS offered without a config: %q", ehlo)
+	}
+	if got, want := c.cmd("STARTTLS"), "454 TLS not available"; got != want {
+		t.Errorf("STARTTLS: got %q, want %q", got, want)
+	}
+}
+
+func TestConnectHook(t *testing.T) {
+	type key struct{}
+	for _, tc := range []struct {
+		name      string
+		hook      ConnectHook
+		wantValue any
+		wantReply string
+	}{
+		{"annotate", func(ctx context.Context, remoteAddr net.Addr) (context.Context, error) {
+			return context.WithValue(ctx, key{}, "annotated"), nil
+		}, "annotated", "221 ok"},
+		{"nil context", func(ctx context.Context, remoteAddr net.Addr) (context.Context, error) {
+			return nil, nil
+		}, nil, "221 ok"},
+		{"refuse", func(ctx context.Context, remoteAddr net.Addr) (context.Context, error) {
+			return nil, &SMTPError{Code: 554, Enhanced: "5.7.1", Message: "go away"}
+		}, nil, "554 5.7.1 go away"},
+	} {
+		var value any
+		s := NewServer("test", func(ctx context.Context, m *Mail) error {
+			value = ctx.Value(key{})
+			return nil
+		}, WithConnectHook(tc.hook))
+
+		replies := converse(t, s, "EHLO client\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.com>\r\nDATA\r\nhello\r\n.\r\nQUIT\r\n")
+		if got := replies[len(replies)-1]; got != tc.wantReply {
+			t.Errorf("%s: got replies %q, want them to end in %q", tc.name, replies, tc.wantReply)
+		}
+		if value != tc.wantValue {
+			t.Errorf("%s: handler got value %v, want %v", tc.name, value, tc.wantValue)
+		}
+	}
+}
+
+func TestBdatTooLarge(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		chunks     string
+		wantCalled bool
+	}{
+		{"first chunk", "BDAT 100000 LAST\r\n", false},
+		{"huge first chunk", "BDAT 9223372036854775807 LAST\r\n", false},
+		{"second chunk", "BDAT 5\r\nhelloBDAT 32764 LAST\r\n", true},
+		{"huge second chunk", "BDAT 5\r\nhelloBDAT 9223372036854775807 LAST\r\n", true},
+	} {
+		var called atomic.Bool
+		var handlerErr error
+		s := NewServer("test", nil, WithStreamHandler(func(ctx context.Context, envelope *Envelope, body io.Reader) error {
+			called.Store(true)
+			_, handlerErr = io.ReadAll(body)
+			return nil
+		}))
+
+		replies := converse(t, s, "EHLO client\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.com>\r\n"+tc.chunks+"QUIT\r\n")
+		if got, want := replies[len(replies)-1], "552 too much data"; got != want {
+			t.Errorf("%s: got replies %q, want them to end in %q", tc.name, replies, want)
+		}
+		if called.Load() != tc.wantCalled {
+			t.Errorf("%s: handler called %v, want %v", tc.name, called.Load(), tc.wantCalled)
+		}
+		if tc.wantCalled && handlerErr != errTooMuchMail {
+			t.Errorf("%s: handler got error %v, want %v", tc.name, handlerErr, errTooMuchMail)
+		}
+	}
+}
+
+func TestMailSize(t *testing.T) {
+	for _, tc := range []struct {
+		params, want string
+	}{
+		{"SIZE=1000", "250 ok"},
+		{"SIZE=32768", "250 ok"},
+		{"SIZE=32769", "552 5.3.4 message size exceeds fixed maximum message size"},
+		{"SIZE=99999999999999999999", "552 5.3.4 message size exceeds fixed maximum message size"},
+		{"SIZE=-99999999999999999999", "501 5.5.4 bad SIZE parameter"},
+		{"SIZE=-1", "501 5.5.4 bad SIZE parameter"},
+		{"SIZE=big", "501 5.5.4 bad SIZE parameter"},
+		{"SIZE", "501 5.5.4 bad SIZE parameter"},
+	} {
+		s := NewServer("test", func(ctx context.Context, m *Mail) error {
+			return nil
+		})
+
+		replies := converse(t, s, "EHLO client\r\nMAIL FROM:<a@example.com> "+tc.params+"\r\nQUIT\r\n")
+		if got := replies[len(replies)-2]; got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.params, got, tc.want)
+		}
+	}
+}
+
+func TestParams(t *testing.T) {
+	for _, tc := range []struct {
+		command, want string
+	}{
+		{"MAIL FROM:<a@example.com> BODY=8BITMIME SMTPUTF8 RET=HDRS ENVID=x", "250 ok"},
+		{"MAIL FROM:<a@example.com> SIZE=1 SIZE=999999999", "555 5.5.4 duplicate parameter"},
+		{"MAIL FROM:<a@example.com> size=1 Size=2", "555 5.5.4 duplicate parameter"},
+		{"MAIL FROM:<a@example.com> X-FOO=1", "555 5.5.4 unrecognized parameter"},
+		{"MAIL FROM:<a@example.com> NOTIFY=NEVER", "555 5.5.4 unrecognized parameter"},
+		{"RCPT TO:<b@example.com> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;b@example.com", "250 ok"},
+		{"RCPT TO:<b@example.com> NOTIFY=NEVER NOTIFY=SUCCESS", "555 5.5.4 duplicate parameter"},
+		{"RCPT TO:<b@example.com> SIZE=1", "555 5.5.4 unrecognized parameter"},
+	} {
+		s := NewServer("test", func(ctx context.Context, m *Mail) error {
+			return nil
+		})
+
+		input := "EHLO client\r\n" + tc.command + "\r\nQUIT\r\n"
+		if strings.HasPrefix(tc.command, "RCPT") {
+			input = "EHLO client\r\nMAIL FROM:<a@example.com>\r\n" + tc.command + "\r\nQUIT\r\n"
+		}
+		replies := converse(t, s, input)
+		if got := replies[len(replies)-2]; got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.command, got, tc.want)
+		}
+	}
+}
+
+func TestDataLineTooLong(t *testing.T) {
+	var got []string
+	s := NewServer("test", func(ctx context.Context, m *Mail) error {
+		got = append(got, m.Mail)
+		return nil
+	}, WithReadBufferSize(MinReadBufferSize))
+
+	long := strings.Repeat("x", 3*MinReadBufferSize)
+	replies := converse(t, s, "EHLO client\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.com>\r\nDATA\r\n"+
+		"Subject: hi\r\n\r\n"+long+"\r\nmore\r\n"+long+"\r\n.\r\n"+
+		"MAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.com>\r\nDATA\r\nhello\r\n.\r\nQUIT\r\n")
+
+	want := []string{"354 here we go", "500 5.5.2 line too long", "250 ok", "250 ok", "354 here we go", "250 ok", "221 ok"}
+	if got := replies[len(replies)-len(want):]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got replies %q, want them to end in %q", replies, want)
+	}
+	if want := []string{"hello\r\n"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got e-mails %q, want %q", got, want)
+	}
+}
+
+func TestBodyAfterHandler(t *testing.T) {
+	proceed, errc := make(chan bool), make(chan error)
+	s := NewServer("test", nil, WithStreamHandler(func(ctx context.Context, envelope *Envelope, body io.Reader) error {
+		go func() {
+			<-proceed
+			_, err := io.ReadAll(body)
+			errc <- err
+		}()
+		return nil
+	}))
+
+	replies := converse(t, s, "EHLO client\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.com>\r\nDATA\r\nhello\r\n.\r\nNOOP\r\nQUIT\r\n")
+	want := []string{"354 here we go", "250 ok", "250 ok", "221 ok"}
+	if got := replies[len(replies)-4:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got replies %q, want them to end in %q", replies, want)
+	}
+
+	close(proceed)
+	if err := <-errc; err != errBodyClosed {
+		t.Errorf("reading body after the handler returned: got %v, want %v", err, errBodyClosed)
+	}
+}
@@ -0,0 +1,47 @@
+package smtp
+
+import (
+	"strings"
+)
+
+// VERPEncode returns a return path for mail from sender to recipient that
+// encodes the recipient, in the style of variable envelope return paths:
+// for sender bounces@example.com and recipient alice@example.org it returns
+// bounces+alice=example.org@example.com. Bounces sent to it identify the
+// failed recipient without parsing their content; see VERPDecode.
+func VERPEncode(sender, recipient string) string {
+	senderLocal, senderDomain, ok := strings.Cut(sender, "@")
+	if !ok {
+		return sender
+	}
+	idx := strings.LastIndex(recipient, "@")
+	if idx == -1 {
+		return sender
+	}
+	return senderLocal + "+" + recipient[:idx] + "=" + recipient[idx+1:] + "@" + senderDomain
+}
+
+// VERPDecode returns the recipient encoded by VERPEncode in address, the
+// recipient of a bounce, for the given sender. It reports false if address
+// is not a VERP address of sender.
+func VERPDecode(sender, address string) (string, bool) {
+	senderLocal, senderDomain, ok := strings.Cut(sender, "@")
+	if !ok {
+		return "", false
+	}
+	idx := strings.LastIndex(address, "@")
+	if idx == -1 || !strings.EqualFold(address[idx+1:], senderDomain) {
+		return "", false
+	}
+	tag, ok := strings.CutPrefix(address[:idx], senderLocal+"+")
+	if !ok {
+		return "", false
+	}
+	// Domains cannot contain '=', so the last one separates the
+	// recipient's local part from its domain.
+	eq := strings.LastIndex(tag, "=")
+	if eq <= 0 || eq == len(tag)-1 {
+		return "", false
+	}
+	return tag[:eq] + "@" + tag[eq+1:], true
+}